@@ -0,0 +1,157 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+)
+
+var (
+	// templateFieldPattern finds attributes referenced as {{.attr}} or {{index . "attr"}} in a template
+	templateFieldPattern = regexp.MustCompile(`\.([A-Za-z][A-Za-z0-9-]*)|index\s+\.\s+"([^"]+)"`)
+
+	templateFuncs = template.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+	}
+)
+
+// attributeMapping sources a single user field either from an LDAP attribute or from a Go template over all attributes
+type attributeMapping struct {
+	attribute string
+	template  *template.Template
+	selectors []string
+}
+
+// newAttributeMapping parses value as template if it contains "{{", otherwise as attribute name
+func newAttributeMapping(name, value string) (attributeMapping, error) {
+	var mapping attributeMapping
+
+	if !strings.Contains(value, "{{") {
+		mapping.attribute = value
+		if value != "" {
+			mapping.selectors = []string{value}
+		}
+
+		return mapping, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(value)
+	if err != nil {
+		return mapping, err
+	}
+
+	mapping.template = tmpl
+	for _, match := range templateFieldPattern.FindAllStringSubmatch(value, -1) {
+		mapping.selectors = append(mapping.selectors, match[1]+match[2])
+	}
+
+	return mapping, nil
+}
+
+// isSet returns whether the mapping sources a value at all
+func (mapping attributeMapping) isSet() bool {
+	return mapping.attribute != "" || mapping.template != nil
+}
+
+// value of the mapping for the given entry
+func (mapping attributeMapping) value(entry *ldapauthenticator.Entry) string {
+	if mapping.template == nil {
+		if mapping.attribute == "" {
+			return ""
+		}
+
+		return attributeValue(entry, mapping.attribute)
+	}
+
+	data := make(map[string]string)
+	for _, attr := range entry.Attributes {
+		if len(attr.Values) > 0 {
+			data[attr.Name] = attr.Values[0]
+		}
+	}
+
+	// attributes referenced in the template may differ in case from the schema
+	for _, selector := range mapping.selectors {
+		if _, found := data[selector]; !found {
+			data[selector] = attributeValue(entry, selector)
+		}
+	}
+
+	var result strings.Builder
+	if err := mapping.template.Execute(&result, data); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(result.String())
+}
+
+// attributeValue returns the first value of the attribute, comparing its name case-insensitively
+func attributeValue(entry *ldapauthenticator.Entry, name string) string {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, name) && len(attr.Values) > 0 {
+			return attr.Values[0]
+		}
+	}
+
+	return ""
+}
+
+// userMapping holds the mappings of all user fields synced to Mattermost
+type userMapping struct {
+	Email     attributeMapping
+	Name      attributeMapping
+	FirstName attributeMapping
+	LastName  attributeMapping
+	Nickname  attributeMapping
+	Position  attributeMapping
+	Locale    attributeMapping
+	Username  attributeMapping
+}
+
+// newUserMapping compiles the attributes section of the configuration, falling back to mail, cn and uid
+func newUserMapping(config AttributesConfig) (userMapping, error) {
+	var mapping userMapping
+	var err error
+
+	fields := []struct {
+		target       *attributeMapping
+		name, value  string
+		defaultValue string
+	}{
+		{&mapping.Email, "email", config.Email, "mail"},
+		{&mapping.Name, "name", config.Name, "cn"},
+		{&mapping.FirstName, "firstName", config.FirstName, ""},
+		{&mapping.LastName, "lastName", config.LastName, ""},
+		{&mapping.Nickname, "nickname", config.Nickname, ""},
+		{&mapping.Position, "position", config.Position, ""},
+		{&mapping.Locale, "locale", config.Locale, ""},
+		{&mapping.Username, "username", config.Username, "uid"},
+	}
+
+	for _, field := range fields {
+		value := field.value
+		if value == "" {
+			value = field.defaultValue
+		}
+
+		if *field.target, err = newAttributeMapping(field.name, value); err != nil {
+			return mapping, err
+		}
+	}
+
+	return mapping, nil
+}
+
+// selectors returns all LDAP attributes needed by the mapping
+func (mapping userMapping) selectors() []string {
+	var selectors []string
+	for _, field := range []attributeMapping{mapping.Email, mapping.Name, mapping.FirstName, mapping.LastName, mapping.Nickname, mapping.Position, mapping.Locale, mapping.Username} {
+		selectors = append(selectors, field.selectors...)
+	}
+
+	return selectors
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+func TestAttributeMapping(t *testing.T) {
+	entry := ldap.NewEntry("uid=jdoe,ou=people,dc=example,dc=org", map[string][]string{
+		"uid":             {"jdoe"},
+		"givenName":       {"Jane"},
+		"sn":              {"Doe"},
+		"mail":            {"Jane.Doe@Example.org", "jane@example.org"},
+		"preferredLocale": {" de "},
+	})
+
+	tests := []struct {
+		name      string
+		value     string
+		expected  string
+		selectors []string
+	}{
+		{"empty", "", "", nil},
+		{"attribute", "uid", "jdoe", []string{"uid"}},
+		{"attribute ignoring case", "GIVENNAME", "Jane", []string{"GIVENNAME"}},
+		{"first value", "mail", "Jane.Doe@Example.org", []string{"mail"}},
+		{"missing attribute", "title", "", []string{"title"}},
+		{"template", "{{.givenName}} {{.sn}}", "Jane Doe", []string{"givenName", "sn"}},
+		{"template functions", "{{lower .mail}}", "jane.doe@example.org", []string{"mail"}},
+		{"template index", `{{index . "sn" | upper}}`, "DOE", []string{"sn"}},
+		{"template trims", "{{.givenName}} {{.title}}", "Jane", []string{"givenName", "title"}},
+		{"template ignoring case", "{{.GivenName}}-{{trim .preferredLocale}}", "Jane-de", []string{"GivenName", "preferredLocale"}},
+	}
+
+	for _, test := range tests {
+		mapping, err := newAttributeMapping(test.name, test.value)
+		if err != nil {
+			t.Errorf("%s: newAttributeMapping(%q) failed: %s", test.name, test.value, err)
+			continue
+		}
+
+		if actual := mapping.value(entry); actual != test.expected {
+			t.Errorf("%s: value of %q = %q, expected %q", test.name, test.value, actual, test.expected)
+		}
+		if !reflect.DeepEqual(mapping.selectors, test.selectors) {
+			t.Errorf("%s: selectors of %q = %v, expected %v", test.name, test.value, mapping.selectors, test.selectors)
+		}
+		if mapping.isSet() != (test.value != "") {
+			t.Errorf("%s: isSet of %q = %t", test.name, test.value, mapping.isSet())
+		}
+	}
+}
+
+func TestAttributeMappingInvalidTemplate(t *testing.T) {
+	for _, value := range []string{"{{.givenName", "{{unknown .sn}}"} {
+		if _, err := newAttributeMapping("invalid", value); err == nil {
+			t.Errorf("newAttributeMapping(%q) succeeded, expected an error", value)
+		}
+	}
+}
+
+func TestUserMappingDefaults(t *testing.T) {
+	mapping, err := newUserMapping(AttributesConfig{Name: "{{.givenName}} {{.sn}}", Locale: "preferredLanguage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"mail", "givenName", "sn", "preferredLanguage", "uid"}
+	if selectors := mapping.selectors(); !reflect.DeepEqual(selectors, expected) {
+		t.Errorf("selectors = %v, expected %v", selectors, expected)
+	}
+}
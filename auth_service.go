@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// authServiceOpenID is Mattermost's OpenID Connect service, unknown to the vendored model
+const authServiceOpenID = "openid"
+
+// supportedAuthServices lists the Mattermost OAuth services this server can emulate
+var supportedAuthServices = []string{model.USER_AUTH_SERVICE_GITLAB, authServiceOpenID, model.SERVICE_GOOGLE, model.SERVICE_OFFICE365}
+
+// ConfigureAuthService sets the Mattermost auth service to emulate. Users of previousServices
+// are converted to it by the sync, keeping their AuthData.
+func (auth *AuthenticatorWithSync) ConfigureAuthService(service string, previousServices []string) error {
+	if service == "" {
+		service = model.USER_AUTH_SERVICE_GITLAB
+	}
+
+	for _, s := range append([]string{service}, previousServices...) {
+		if !isSupportedAuthService(s) {
+			return fmt.Errorf("unsupported auth service %s", s)
+		}
+	}
+
+	auth.authService = service
+	auth.previousAuthServices = previousServices
+
+	return nil
+}
+
+func isSupportedAuthService(service string) bool {
+	for _, supported := range supportedAuthServices {
+		if service == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isOAuthUser returns whether the user logs in via this server, either with the current or a previous service
+func (auth *AuthenticatorWithSync) isOAuthUser(user *model.User) bool {
+	if user.AuthService == auth.authService {
+		return true
+	}
+
+	for _, service := range auth.previousAuthServices {
+		if user.AuthService == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAuthService converts users of a previous auth service to the current one
+func (auth *AuthenticatorWithSync) checkAuthService(user *model.User) error {
+	if user.AuthService == auth.authService || user.AuthData == nil {
+		return nil
+	}
+
+	if !auth.planChange(actionUpdateAuthService, user.Username, auth.authService, user.AuthService) {
+		return nil
+	}
+
+	userAuth := model.UserAuth{AuthService: auth.authService, AuthData: user.AuthData}
+	if _, resp := auth.Mattermost().UpdateUserAuth(user.Id, &userAuth); resp.Error != nil {
+		logging.Errorf("Could not convert user %s to auth service %s, got error: %+v", user.Username, auth.authService, resp.Error)
+		auth.changeFailed(actionUpdateAuthService, user.Username, auth.authService)
+		return resp.Error
+	}
+
+	user.AuthService = auth.authService
+	logging.Infof("Converted user %s to auth service %s", user.Username, auth.authService)
+
+	return nil
+}
+
+// openIDUserInfo is the userinfo response of an OpenID Connect provider
+type openIDUserInfo struct {
+	Sub               string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	GivenName         string `json:"given_name"`
+	FamilyName        string `json:"family_name"`
+	Nickname          string `json:"nickname,omitempty"`
+	PreferredUsername string `json:"preferred_username"`
+	Locale            string `json:"locale,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+}
+
+// googleUserInfo is the response of Google's People API as read by Mattermost
+type googleUserInfo struct {
+	ResourceName   string        `json:"resourceName"`
+	Names          []googleName  `json:"names"`
+	Nicknames      []googleValue `json:"nicknames"`
+	EmailAddresses []googleValue `json:"emailAddresses"`
+}
+
+type googleName struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+type googleValue struct {
+	Value string `json:"value"`
+}
+
+// office365UserInfo is the response of Microsoft Graph's /me endpoint
+type office365UserInfo struct {
+	ID                string `json:"id"`
+	DisplayName       string `json:"displayName"`
+	GivenName         string `json:"givenName"`
+	Surname           string `json:"surname"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	JobTitle          string `json:"jobTitle,omitempty"`
+}
+
+// forService shapes the user data like the user info endpoint of the given service does
+func (data userData) forService(service string) interface{} {
+	switch service {
+	case authServiceOpenID:
+		return openIDUserInfo{
+			Sub:               data.authData(),
+			Email:             data.Email,
+			EmailVerified:     true,
+			Name:              data.Name,
+			GivenName:         data.FirstName,
+			FamilyName:        data.LastName,
+			Nickname:          data.Nickname,
+			PreferredUsername: data.Username,
+			Locale:            data.Locale,
+			Picture:           data.AvatarURL,
+		}
+
+	case model.SERVICE_GOOGLE:
+		info := googleUserInfo{
+			ResourceName:   "people/" + data.authData(),
+			Names:          []googleName{{GivenName: data.FirstName, FamilyName: data.LastName}},
+			EmailAddresses: []googleValue{{Value: data.Email}},
+		}
+		if data.Nickname != "" {
+			info.Nicknames = []googleValue{{Value: data.Nickname}}
+		}
+		return info
+
+	case model.SERVICE_OFFICE365:
+		return office365UserInfo{
+			ID:                data.authData(),
+			DisplayName:       data.Name,
+			GivenName:         data.FirstName,
+			Surname:           data.LastName,
+			Mail:              data.Email,
+			UserPrincipalName: data.Email,
+			JobTitle:          data.Position,
+		}
+	}
+
+	// GitLab's /api/v4/user
+	return data
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// channelMapping maps LDAP groups onto a single channel within a team
+type channelMapping struct {
+	name        string
+	team        string
+	displayName string
+	private     bool
+	groups      []string
+	// direct only counts direct members of the groups if nested groups are resolved
+	direct bool
+}
+
+// ConfigureChannels applies the channel section of the configuration
+func (auth *AuthenticatorWithSync) ConfigureChannels(channels map[string]*ChannelConfig) {
+	auth.channelMappings = nil
+
+	for name, channel := range channels {
+		mapping := channelMapping{
+			name:        name,
+			team:        channel.Team,
+			displayName: channel.DisplayName,
+			private:     channel.Private,
+			groups:      channel.Group,
+			direct:      strings.EqualFold(channel.Membership, membershipDirect),
+		}
+
+		if mapping.displayName == "" {
+			mapping.displayName = name
+		}
+
+		auth.channelMappings = append(auth.channelMappings, mapping)
+	}
+
+	// keep the order of applied changes stable
+	sort.Slice(auth.channelMappings, func(i, j int) bool {
+		return auth.channelMappings[i].team+"/"+auth.channelMappings[i].name < auth.channelMappings[j].team+"/"+auth.channelMappings[j].name
+	})
+}
+
+// matches returns whether one of the given groups feeds this channel
+func (mapping channelMapping) matches(groups []group) bool {
+	for _, group := range membershipGroups(groups, mapping.direct) {
+		for _, groupUID := range mapping.groups {
+			if group.uid == groupUID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// channelTeamsForUser returns the names of all teams the user needs to be part of due to channel mappings
+func (auth *AuthenticatorWithSync) channelTeamsForUser(groups []group) map[string]bool {
+	teams := make(map[string]bool)
+	for _, mapping := range auth.channelMappings {
+		if mapping.matches(groups) {
+			teams[mapping.team] = true
+		}
+	}
+
+	return teams
+}
+
+// syncChannelsForUser adds the user to all mapped channels of their groups and removes them from all others
+func (auth *AuthenticatorWithSync) syncChannelsForUser(user *model.User, groups []group) error {
+	var errs syncErrors
+	for _, mapping := range auth.channelMappings {
+		member := mapping.matches(groups)
+
+		team, resp := auth.Mattermost().GetTeamByName(mapping.team, "")
+		if resp.Error != nil {
+			if member || resp.StatusCode != 404 {
+				logging.Errorf("Could not find team %s for channel %s, got error: %+v", mapping.team, mapping.name, resp.Error)
+				errs.add(resp.Error)
+			}
+			continue
+		}
+
+		channel, resp := auth.Mattermost().GetChannelByName(mapping.name, team.Id, "")
+		if resp.Error != nil && resp.StatusCode != 404 {
+			logging.Errorf("Could not find channel %s, got error: %+v", mapping.name, resp.Error)
+			errs.add(resp.Error)
+			continue
+		}
+
+		if resp.StatusCode == 404 {
+			if !member {
+				continue
+			}
+
+			var err error
+			if channel, err = auth.createMappedChannel(team, mapping); channel == nil {
+				errs.add(err)
+				if auth.dryRun {
+					auth.planChange(actionAddChannelMember, user.Username, mapping.team+"/"+mapping.name, "")
+				}
+				continue
+			}
+		}
+
+		_, resp = auth.Mattermost().GetChannelMember(channel.Id, user.Id, "")
+		if resp.Error != nil && resp.StatusCode != 404 {
+			logging.Errorf("Could not fetch membership of %s in channel %s, got error: %+v", user.Username, mapping.name, resp.Error)
+			errs.add(resp.Error)
+			continue
+		}
+		isMember := resp.StatusCode != 404
+
+		if member && !isMember {
+			errs.add(auth.addChannelMember(team, channel, user))
+		}
+
+		if member && isMember {
+			auth.markManaged(bucketManagedChannelMember, channel.Id, user.Id)
+		}
+
+		// memberships added by admins are left alone
+		if !member && isMember && auth.isManaged(bucketManagedChannelMember, channel.Id, user.Id) {
+			errs.add(auth.removeChannelMember(team, channel, user))
+		}
+	}
+
+	return errs.err()
+}
+
+// createMappedChannel creates the channel of the mapping and returns nil if it has not been created
+func (auth *AuthenticatorWithSync) createMappedChannel(team *model.Team, mapping channelMapping) (*model.Channel, error) {
+	channelType := model.CHANNEL_OPEN
+	if mapping.private {
+		channelType = model.CHANNEL_PRIVATE
+	}
+
+	auth.creationMutex.Lock()
+	defer auth.creationMutex.Unlock()
+
+	// another worker may have created the channel meanwhile
+	if channel, resp := auth.Mattermost().GetChannelByName(mapping.name, team.Id, ""); resp.Error == nil {
+		return channel, nil
+	}
+
+	if !auth.planChange(actionCreateChannel, "", team.Name+"/"+mapping.name, channelType) {
+		return nil, nil
+	}
+
+	newChannel := model.Channel{}
+	newChannel.TeamId = team.Id
+	newChannel.Name = mapping.name
+	newChannel.DisplayName = mapping.displayName
+	newChannel.Type = channelType
+
+	channel, resp := auth.Mattermost().CreateChannel(&newChannel)
+	if resp.Error != nil {
+		logging.Errorf("Could not create channel %s, got error: %+v", mapping.name, resp.Error)
+		auth.changeFailed(actionCreateChannel, "", team.Name+"/"+mapping.name)
+		return nil, resp.Error
+	}
+
+	logging.Infof("Created new channel %s in team %s.", channel.DisplayName, team.DisplayName)
+
+	return channel, nil
+}
+
+func (auth *AuthenticatorWithSync) addChannelMember(team *model.Team, channel *model.Channel, user *model.User) error {
+	logger := logging.With("user", user.Username, "team", team.Name, "channel", channel.Name)
+
+	// channel members have to be team members
+	if _, resp := auth.Mattermost().GetTeamMember(team.Id, user.Id, ""); resp.StatusCode == 404 {
+		if !auth.planChange(actionAddTeamMember, user.Username, team.Name, "") {
+			return nil
+		}
+
+		if _, resp := auth.Mattermost().AddTeamMember(team.Id, user.Id); resp.Error != nil {
+			logger.Errorf("Could not add user %s to team %s, got error: %+v", user.Username, team.Name, resp.Error)
+			auth.changeFailed(actionAddTeamMember, user.Username, team.Name)
+			return resp.Error
+		}
+		auth.markManaged(bucketManagedTeamMember, team.Id, user.Id)
+	}
+
+	if !auth.planChange(actionAddChannelMember, user.Username, team.Name+"/"+channel.Name, "") {
+		return nil
+	}
+
+	if _, resp := auth.Mattermost().AddChannelMember(channel.Id, user.Id); resp.Error != nil {
+		logger.Errorf("Could not add user %s to channel %s, got error: %+v", user.Username, channel.Name, resp.Error)
+		auth.changeFailed(actionAddChannelMember, user.Username, team.Name+"/"+channel.Name)
+		return resp.Error
+	}
+	auth.markManaged(bucketManagedChannelMember, channel.Id, user.Id)
+
+	logger.Infof("Added user %s to channel %s", user.Username, channel.DisplayName)
+
+	return nil
+}
+
+func (auth *AuthenticatorWithSync) removeChannelMember(team *model.Team, channel *model.Channel, user *model.User) error {
+	logger := logging.With("user", user.Username, "team", team.Name, "channel", channel.Name)
+
+	if !auth.planChange(actionRemoveChannelMember, user.Username, team.Name+"/"+channel.Name, "") {
+		return nil
+	}
+
+	if _, resp := auth.Mattermost().RemoveUserFromChannel(channel.Id, user.Id); resp.Error != nil {
+		logger.Errorf("Could not remove user %s from channel %s, got error: %+v", user.Username, channel.Name, resp.Error)
+		auth.changeFailed(actionRemoveChannelMember, user.Username, team.Name+"/"+channel.Name)
+		return resp.Error
+	}
+	auth.forgetManaged(bucketManagedChannelMember, channel.Id, user.Id)
+
+	logger.Infof("Removed user %s from channel %s", user.Username, channel.DisplayName)
+
+	return nil
+}
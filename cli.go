@@ -9,11 +9,20 @@ type cliParameters struct {
 	StartServer  *bool
 	AddClient    *bool
 	RevokeClient *bool
+	Sync         *bool
+	FullSync     *bool
+	SyncUser     *string
+	MigrateUsers *bool
 
 	ClientID     *string
 	ClientSecret *string
 	RedirectURI  *string
 
+	DryRun       *bool
+	PlanFormat   *string
+	MigrateMatch *string
+	MigrateMap   *string
+
 	ConfigPath *string
 }
 
@@ -28,13 +37,21 @@ func handleCLIParameters(params *cliParameters) (err error) {
 	params.ClientID = flag.String("client-id", "", "The new ClientId to be added or revoked.")
 	params.ClientSecret = flag.String("client-secret", "", "The new ClientSecret.")
 	params.RedirectURI = flag.String("redirect-uri", "", "The RedirectUri.")
+	params.Sync = flag.Bool("sync", false, "Runs a sync once and exits, incremental if enabled in the config.")
+	params.FullSync = flag.Bool("full-sync", false, "Forces a full sync, together with -sync.")
+	params.SyncUser = flag.String("sync-user", "", "Syncs the user with the given uid once and exits.")
+	params.MigrateUsers = flag.Bool("migrate-users", false, "Converts Mattermost email users matching an LDAP entry to OAuth users.")
+	params.MigrateMatch = flag.String("migrate-match", "mail", "How to match email users against LDAP entries, either mail (verified addresses only) or map.")
+	params.MigrateMap = flag.String("migrate-map", "", "File of \"username uid\" lines confirmed by an admin, together with -migrate-match map.")
+	params.DryRun = flag.Bool("dry-run", false, "Only prints the changes a sync or migration would apply, together with -sync or -migrate-users.")
+	params.PlanFormat = flag.String("plan-format", "table", "Output format of the sync changes, either table or json.")
 	params.ConfigPath = flag.String("config", "", "Path to config file in ini format.")
 
 	flag.Parse()
 
 	// Validate CLI values
-	if !(*params.StartServer) && !(*params.AddClient) && !(*params.RevokeClient) {
-		err = errors.New("You need to specify StartServer, AddClient or RevokeClient")
+	if !(*params.StartServer) && !(*params.AddClient) && !(*params.RevokeClient) && !(*params.Sync) && *(params.SyncUser) == "" && !(*params.MigrateUsers) {
+		err = errors.New("You need to specify StartServer, AddClient, RevokeClient, Sync, SyncUser or MigrateUsers")
 	}
 
 	if *params.ConfigPath == "" {
@@ -45,6 +62,38 @@ func handleCLIParameters(params *cliParameters) (err error) {
 		err = errors.New("You can not add/revoke a client and start the server")
 	}
 
+	if *(params.Sync) && (*(params.StartServer) || *(params.AddClient) || *(params.RevokeClient)) {
+		err = errors.New("Can not sync once together with other commands")
+	}
+
+	if *(params.SyncUser) != "" && (*(params.StartServer) || *(params.AddClient) || *(params.RevokeClient) || *(params.Sync) || *(params.MigrateUsers)) {
+		err = errors.New("Can not sync a user together with other commands")
+	}
+
+	if *(params.MigrateUsers) && (*(params.StartServer) || *(params.AddClient) || *(params.RevokeClient) || *(params.Sync)) {
+		err = errors.New("Can not migrate users together with other commands")
+	}
+
+	if *(params.DryRun) && !*(params.Sync) && !*(params.MigrateUsers) {
+		err = errors.New("Dry-run is only possible together with Sync or MigrateUsers")
+	}
+
+	if *(params.FullSync) && !*(params.Sync) {
+		err = errors.New("FullSync is only possible together with Sync")
+	}
+
+	if *(params.MigrateMatch) != "mail" && *(params.MigrateMatch) != "map" {
+		err = errors.New("Invalid MigrateMatch")
+	}
+
+	if (*(params.MigrateMatch) == "map") != (*(params.MigrateMap) != "") {
+		err = errors.New("MigrateMap is required together with MigrateMatch map")
+	}
+
+	if *(params.PlanFormat) != "table" && *(params.PlanFormat) != "json" {
+		err = errors.New("Invalid PlanFormat")
+	}
+
 	if *(params.AddClient) && *(params.RevokeClient) {
 		err = errors.New("Can not revoke and add at the same time")
 	}
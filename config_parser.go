@@ -1,9 +1,11 @@
 package main
 
 import (
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
 	gcfg "gopkg.in/gcfg.v1"
 
-	"log"
+	"io/ioutil"
+	"strings"
 )
 
 // MysqlConfig describes all possible MySQL configuration fields
@@ -25,9 +27,43 @@ type LdapConfig struct {
 	GroupMemberQuery string
 	GroupBaseDN      string
 
+	// GroupObjectClass restricts groups to these object classes, e.g. groupOfNames or posixGroup
+	GroupObjectClass []string
+	// GroupIDAttribute names the team, ou if empty. GroupNameAttribute is its display name, cn if empty.
+	GroupIDAttribute          string
+	GroupNameAttribute        string
+	GroupDescriptionAttribute string
+	// GroupMembership is member (the default), uniqueMember, memberUid or memberOf
+	GroupMembership string
+	// NestedGroups makes members of a subgroup members of its parent groups, up to NestedGroupDepth levels
+	NestedGroups     bool
+	NestedGroupDepth int
+
+	DisabledAttribute string
+	DisabledValue     []string
+
 	AttrSelectors []string
 }
 
+// AttributesConfig maps LDAP attributes onto Mattermost user fields. Each value is either
+// an attribute name or a Go template over the attributes like "{{.givenName}} {{.sn}}".
+type AttributesConfig struct {
+	// ID is an immutable attribute identifying users in Mattermost, e.g. entryUUID. Defaults to uid.
+	ID        string
+	Email     string
+	Name      string
+	FirstName string
+	LastName  string
+	Nickname  string
+	Position  string
+	Locale    string
+	Username  string
+
+	// Picture is the binary attribute holding the profile picture
+	Picture     string
+	PictureSize int
+}
+
 // OauthConfig describes all possible Oauth configuration fields
 type OauthConfig struct {
 	StaticPath   string
@@ -36,34 +72,189 @@ type OauthConfig struct {
 	RouteLogin   string
 	RouteToken   string
 	RouteInfo    string
+	RouteAvatar  string
+	// AvatarRateLimit is the number of profile pictures served per second, AvatarRateBurst the number of requests allowed at once
+	AvatarRateLimit float64
+	AvatarRateBurst int
+	// AvatarSecret signs the avatar URLs, so uids cannot be enumerated. A random secret is used if empty.
+	AvatarSecret string
+	// RouteJwks serves the key signing the id_tokens of the openid service, OpenIDKeyFile holds it as PEM.
+	// An ephemeral key is generated if OpenIDKeyFile is empty.
+	RouteJwks     string
+	OpenIDKeyFile string
+
+	// Service is the Mattermost auth service to emulate: gitlab, openid, google or office365
+	Service         string
+	PreviousService []string
 }
 
 // MattermostConfig describes all possible Mattermost configuration fields
 type MattermostConfig struct {
-	URL            string
-	Username       string
-	Password       string
+	URL      string
+	Username string
+	Password string
+	// Token is a personal access or bot token used instead of Username and Password
+	Token string
+	// TokenFile holds the token, e.g. provided as container secret
+	TokenFile      string
 	UsernamePrefix string
 }
 
+// AccessToken returns the configured token, reading it from TokenFile if necessary
+func (config MattermostConfig) AccessToken() (string, error) {
+	if config.Token != "" || config.TokenFile == "" {
+		return config.Token, nil
+	}
+
+	token, err := ioutil.ReadFile(config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
+
+// SyncConfig describes all possible sync configuration fields
+type SyncConfig struct {
+	DeactivateUsers         bool
+	RevokeSessions          bool
+	DeactivationGracePeriod string
+	MaxDeactivations        int
+
+	ManagedTeam         []string
+	UnmanagedTeam       []string
+	NeverRemove         bool
+	ProtectedTeamMarker string
+	// TeamArchiveGracePeriod is how long the group of a team has to be gone before the team is archived,
+	// teams are never archived if empty
+	TeamArchiveGracePeriod string
+
+	// StateStore is file (the default), mysql sharing the OAuth database or sqlite.
+	// StateFile is the JSON or SQLite file, a file store is kept in memory only if empty.
+	StateStore string
+	StateFile  string
+
+	// Incremental syncs only users changed since the last run, full syncs are run every FullSyncInterval
+	Incremental      bool
+	FullSyncInterval string
+	// Listen receives changes via syncrepl instead of polling
+	Listen bool
+	// ChangeAttribute tells when an LDAP entry changed, modifyTimestamp if empty
+	ChangeAttribute string
+
+	// Schedule and FullSchedule are cron expressions for the periodic syncs, Schedule syncs incrementally if enabled
+	Schedule     string
+	FullSchedule string
+	// TriggerRoute starts syncs on requests bearing TriggerToken, disabled if either is empty
+	TriggerRoute string
+	TriggerToken string
+
+	// Workers is the number of users synced concurrently
+	Workers int
+	// RateLimit limits the Mattermost API calls per second, 0 means unlimited
+	RateLimit float64
+	RateBurst int
+}
+
+// TeamConfig describes the teams created for LDAP groups
+type TeamConfig struct {
+	// Type is invite (the default) or open
+	Type string
+	// Description may contain the placeholders {name}, {uid} and {description} of the group
+	Description    string
+	AllowedDomains string
+	// DefaultChannel lists channels every member of a created team joins
+	DefaultChannel []string
+	// MaxNameLength truncates longer team names, adding a hash of the group's uid, 64 if 0
+	MaxNameLength int
+}
+
+// ChannelConfig maps LDAP groups onto a channel, the channel name is given as subsection name
+type ChannelConfig struct {
+	Team        string
+	DisplayName string
+	Private     bool
+	Group       []string
+	// Membership is direct to ignore members of subgroups if nested groups are resolved
+	Membership string
+}
+
+// UserGroupConfig mirrors LDAP groups as a Mattermost user group, the group name used for @-mentions is given as subsection name
+type UserGroupConfig struct {
+	DisplayName string
+	Group       []string
+	// Membership is direct to ignore members of subgroups if nested groups are resolved
+	Membership string
+}
+
+// RolesConfig describes the LDAP groups granting Mattermost system roles
+type RolesConfig struct {
+	SystemAdminGroup []string
+	GuestGroup       []string
+	// Membership is direct to ignore members of subgroups if nested groups are resolved
+	Membership string
+}
+
+// TeamAdminsConfig describes the LDAP groups granting the team admin role, the team name is given as subsection name
+type TeamAdminsConfig struct {
+	Group []string
+	// Membership is direct to ignore members of subgroups if nested groups are resolved
+	Membership string
+}
+
+// ReportConfig describes where the summary of every sync run is posted to
+type ReportConfig struct {
+	// Channel is given as team/channel and posted to with the sync account, WebhookURL is used instead if set
+	Channel    string
+	WebhookURL string
+	// OnlyFailures only reports runs with errors
+	OnlyFailures bool
+	// ErrorThreshold turns the report into an alert mentioning AlertMention if a run has at least this many errors
+	ErrorThreshold int
+	AlertMention   string
+}
+
 // GeneralConfig describes all general configuration properties
 type GeneralConfig struct {
 	ListenAddr string
+	// PublicURL is the external base URL of this service used to generate links
+	PublicURL string
+	// MetricsRoute serves the Prometheus metrics if set
+	MetricsRoute string
+	// MetricsAddr serves the metrics on a listen address of their own instead of ListenAddr if set
+	MetricsAddr string
+}
+
+// LogConfig describes the log output
+type LogConfig struct {
+	// Level is debug, info (the default), warn or error
+	Level string
+	// Format is text (the default), logfmt or json
+	Format string
 }
 
 type config struct {
 	Ldap       LdapConfig
+	Attributes AttributesConfig
 	Mysql      MysqlConfig
 	Oauth      OauthConfig
 	Mattermost MattermostConfig
+	Sync       SyncConfig
+	Team       TeamConfig
+	Channel    map[string]*ChannelConfig
+	UserGroup  map[string]*UserGroupConfig
+	Roles      RolesConfig
+	TeamAdmins map[string]*TeamAdminsConfig
 	General    GeneralConfig
+	Log        LogConfig
+	Report     ReportConfig
 }
 
 func parseConfig(path string) (cfg config) {
 	err := gcfg.ReadFileInto(&cfg, path)
 
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 
 	return
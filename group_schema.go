@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// membership styles telling how groups list their members
+const (
+	// membershipMember lists member DNs in member (groupOfNames)
+	membershipMember = "member"
+	// membershipUniqueMember lists member DNs in uniqueMember (groupOfUniqueNames)
+	membershipUniqueMember = "uniqueMember"
+	// membershipMemberUID lists member uids in memberUid (posixGroup)
+	membershipMemberUID = "memberUid"
+	// membershipMemberOf lists the group DNs in memberOf of the user, the groups list their members in member
+	membershipMemberOf = "memberOf"
+)
+
+// groupSchema describes how groups are stored in LDAP
+type groupSchema struct {
+	objectClasses        []string
+	idAttribute          string
+	nameAttribute        string
+	descriptionAttribute string
+	membership           string
+
+	// nested resolves the groups a group is a member of, up to nestedDepth levels
+	nested      bool
+	nestedDepth int
+}
+
+func newGroupSchema() groupSchema {
+	return groupSchema{idAttribute: "ou", nameAttribute: "cn", membership: membershipMember, nestedDepth: defaultNestedGroupDepth}
+}
+
+// ConfigureGroups applies the group settings of the LDAP section
+func (auth *AuthenticatorWithSync) ConfigureGroups(config LdapConfig) error {
+	schema := newGroupSchema()
+	schema.objectClasses = config.GroupObjectClass
+
+	if config.GroupIDAttribute != "" {
+		schema.idAttribute = config.GroupIDAttribute
+	}
+	if config.GroupNameAttribute != "" {
+		schema.nameAttribute = config.GroupNameAttribute
+	}
+	schema.descriptionAttribute = config.GroupDescriptionAttribute
+
+	if config.GroupMembership != "" {
+		found := false
+		for _, membership := range []string{membershipMember, membershipUniqueMember, membershipMemberUID, membershipMemberOf} {
+			if strings.EqualFold(config.GroupMembership, membership) {
+				schema.membership = membership
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown group membership %s, expected member, uniqueMember, memberUid or memberOf", config.GroupMembership)
+		}
+	}
+
+	if config.NestedGroups {
+		if schema.membership == membershipMemberUID {
+			return errors.New("nested groups need members given by DN, memberUid lists uids only")
+		}
+
+		schema.nested = true
+		if config.NestedGroupDepth > 0 {
+			schema.nestedDepth = config.NestedGroupDepth
+		}
+	}
+
+	auth.groupSchema = schema
+
+	return nil
+}
+
+// filter restricts the condition to entries of the group object classes
+func (schema groupSchema) filter(condition string) string {
+	if len(schema.objectClasses) == 0 {
+		return condition
+	}
+
+	var classes strings.Builder
+	for _, class := range schema.objectClasses {
+		fmt.Fprintf(&classes, "(objectClass=%s)", ldap.EscapeFilter(class))
+	}
+	if len(schema.objectClasses) > 1 {
+		return fmt.Sprintf("(&(|%s)%s)", classes.String(), condition)
+	}
+
+	return fmt.Sprintf("(&%s%s)", classes.String(), condition)
+}
+
+// attributes returns the group attributes read by the sync
+func (schema groupSchema) attributes() []string {
+	attributes := []string{"dn", schema.idAttribute, schema.nameAttribute}
+	if schema.descriptionAttribute != "" {
+		attributes = append(attributes, schema.descriptionAttribute)
+	}
+
+	return attributes
+}
+
+// memberAttribute returns the attribute of group entries listing their members
+func (schema groupSchema) memberAttribute() string {
+	switch schema.membership {
+	case membershipUniqueMember, membershipMemberUID:
+		return schema.membership
+	}
+
+	return membershipMember
+}
+
+// memberUID returns the lower cased uid of a value of the member attribute
+func (schema groupSchema) memberUID(member string) string {
+	switch schema.membership {
+	case membershipMemberUID:
+		return strings.ToLower(member)
+	case membershipUniqueMember:
+		// uniqueMember values may carry an optional UID like #'0101'B
+		if index := strings.LastIndex(member, "#"); index > 0 {
+			member = member[:index]
+		}
+	}
+
+	return uidFromDN(member)
+}
+
+// resolveMemberUID returns the lower cased uid of a value of the member attribute. Member DNs not named
+// by their uid, like CN=John Doe,... in Active Directory, are looked up once per run.
+func (auth *AuthenticatorWithSync) resolveMemberUID(member string) string {
+	if uid := auth.groupSchema.memberUID(member); uid != "" || auth.groupSchema.membership == membershipMemberUID {
+		return uid
+	}
+
+	if index := strings.LastIndex(member, "#"); index > 0 && auth.groupSchema.membership == membershipUniqueMember {
+		member = member[:index]
+	}
+	dn := normalizeDN(member)
+
+	auth.graphMutex.Lock()
+	uid, cached := auth.memberUIDs[dn]
+	auth.graphMutex.Unlock()
+	if cached {
+		return uid
+	}
+
+	uid, err := auth.authenticator.GetUIDByDN(member)
+	if err != nil && err != ldapauthenticator.ErrUserNotFound {
+		logging.Errorf("Could not look up member %s, got error: %+v", member, err)
+		return ""
+	}
+	uid = strings.ToLower(uid)
+
+	auth.graphMutex.Lock()
+	defer auth.graphMutex.Unlock()
+	if auth.memberUIDs == nil {
+		auth.memberUIDs = make(map[string]string)
+	}
+	auth.memberUIDs[dn] = uid
+
+	return uid
+}
+
+// toGroup reads a group from its entry
+func (schema groupSchema) toGroup(entry *ldap.Entry) group {
+	group := group{uid: entry.GetAttributeValue(schema.idAttribute), name: entry.GetAttributeValue(schema.nameAttribute), dn: entry.DN}
+	if schema.descriptionAttribute != "" {
+		group.description = entry.GetAttributeValue(schema.descriptionAttribute)
+	}
+
+	return group
+}
+
+// searchGroupsForUser returns the groups of the user following the membership style,
+// or using groupMemberQuery if configured
+func (auth *AuthenticatorWithSync) searchGroupsForUser(uid string) ([]group, error) {
+	schema := auth.groupSchema
+	if auth.groupMemberQuery != "" {
+		return auth.searchGroups(fmt.Sprintf(auth.groupMemberQuery, uid, auth.userDn))
+	}
+
+	if schema.membership == membershipMemberUID {
+		return auth.searchGroups(schema.filter(fmt.Sprintf("(memberUid=%s)", ldap.EscapeFilter(uid))))
+	}
+
+	entry, err := auth.authenticator.GetUserEntry(uid, []string{membershipMemberOf})
+	if err != nil {
+		return nil, err
+	}
+
+	if schema.membership != membershipMemberOf {
+		return auth.searchGroups(schema.filter(fmt.Sprintf("(%s=%s)", schema.membership, ldap.EscapeFilter(entry.DN))))
+	}
+
+	var groups []group
+	for _, dn := range entry.GetAttributeValues(membershipMemberOf) {
+		if !isBelow(dn, auth.groupBaseDn) {
+			continue
+		}
+
+		found, err := auth.searchGroupsIn(dn, ldap.ScopeBaseObject, schema.filter("(objectClass=*)"))
+		if err != nil {
+			logging.Errorf("Could not read group %s of user %s, got error: %+v", dn, uid, err)
+			continue
+		}
+		groups = append(groups, found...)
+	}
+
+	return groups, nil
+}
+
+// isBelow returns whether dn equals base or lies below it
+func isBelow(dn, base string) bool {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return false
+	}
+	parsedBase, err := ldap.ParseDN(base)
+	if err != nil {
+		return false
+	}
+
+	return parsed.Equal(parsedBase) || parsedBase.AncestorOf(parsed)
+}
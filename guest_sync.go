@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// isGuestUser returns whether the Mattermost user is a guest account
+func isGuestUser(user *model.User) bool {
+	for _, role := range strings.Fields(user.Roles) {
+		if role == systemGuestRoleID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isGuest returns whether the groups make the user a guest, system admins never are
+func (auth *AuthenticatorWithSync) isGuest(groups []group) bool {
+	if len(auth.rolesConfig.GuestGroup) == 0 {
+		return false
+	}
+
+	groups = membershipGroups(groups, strings.EqualFold(auth.rolesConfig.Membership, membershipDirect))
+	admin := len(auth.rolesConfig.SystemAdminGroup) > 0 && inAnyGroup(groups, auth.rolesConfig.SystemAdminGroup)
+
+	return !admin && inAnyGroup(groups, auth.rolesConfig.GuestGroup)
+}
+
+// syncGuestForUser demotes members of the guest groups to guest accounts and promotes them back once they left.
+// Guests are restricted to the teams and channels of their groups on every sync, since their groups may change.
+// It returns whether the user is meant to be a guest.
+func (auth *AuthenticatorWithSync) syncGuestForUser(user *model.User, groups []group) (bool, error) {
+	logger := logging.With("user", user.Username)
+
+	if len(auth.rolesConfig.GuestGroup) == 0 {
+		// guests are not managed by the sync
+		return isGuestUser(user), nil
+	}
+
+	guest := auth.isGuest(groups)
+	if guest && isGuestUser(user) {
+		return guest, auth.restrictGuest(user, groups)
+	}
+	if guest == isGuestUser(user) {
+		return guest, nil
+	}
+
+	action, route, roles := actionPromoteUser, "/promote", model.SYSTEM_USER_ROLE_ID
+	if guest {
+		action, route, roles = actionDemoteUser, "/demote", systemGuestRoleID
+	}
+
+	if !auth.planChange(action, user.Username, "", "") {
+		return guest, nil
+	}
+
+	client := auth.Mattermost()
+	resp, err := client.DoApiPost(client.GetUserRoute(user.Id)+route, "")
+	if err != nil {
+		logger.Errorf("Could not %s user %s, got error: %+v", route[1:], user.Username, err)
+		auth.changeFailed(action, user.Username, "")
+		return isGuestUser(user), err
+	}
+	resp.Body.Close()
+	user.Roles = roles
+
+	if guest {
+		logger.Infof("Demoted user %s to a guest.", user.Username)
+		return guest, auth.restrictGuest(user, groups)
+	}
+
+	logger.Infof("Promoted guest %s to a regular user.", user.Username)
+
+	return guest, nil
+}
+
+// restrictGuest removes a guest from all teams and channels their groups do not map to.
+// Only the teams managed by the sync are touched, the town square cannot be left.
+func (auth *AuthenticatorWithSync) restrictGuest(user *model.User, groups []group) error {
+	logger := logging.With("user", user.Username)
+
+	allowed := make(map[string]bool)
+	for _, mapping := range auth.channelMappings {
+		if mapping.matches(groups) {
+			allowed[mapping.team+"/"+mapping.name] = true
+		}
+	}
+	channelTeams := auth.channelTeamsForUser(groups)
+
+	teams, resp := auth.Mattermost().GetTeamsForUser(user.Id, "")
+	if resp.Error != nil {
+		logger.Errorf("Could not retrieve teams of guest %s, got error: %+v", user.Username, resp.Error)
+		return resp.Error
+	}
+
+	var errs syncErrors
+	for _, team := range teams {
+		if !auth.teamPolicy.mayRemove(team) {
+			continue
+		}
+
+		if !channelTeams[team.Name] {
+			if !auth.planChange(actionRemoveTeamMember, user.Username, team.Name, "guest") {
+				continue
+			}
+
+			if _, resp := auth.Mattermost().RemoveTeamMember(team.Id, user.Id); resp.Error != nil {
+				logger.Errorf("Could not remove guest %s from team %s, got error: %+v", user.Username, team.Name, resp.Error)
+				auth.changeFailed(actionRemoveTeamMember, user.Username, team.Name)
+				errs.add(resp.Error)
+				continue
+			}
+			auth.forgetManaged(bucketManagedTeamMember, team.Id, user.Id)
+			continue
+		}
+
+		channels, resp := auth.Mattermost().GetChannelsForTeamForUser(team.Id, user.Id, "")
+		if resp.Error != nil {
+			logger.Errorf("Could not retrieve channels of guest %s in team %s, got error: %+v", user.Username, team.Name, resp.Error)
+			errs.add(resp.Error)
+			continue
+		}
+
+		for _, channel := range channels {
+			if channel.Type != model.CHANNEL_OPEN && channel.Type != model.CHANNEL_PRIVATE {
+				continue
+			}
+
+			if channel.Name != model.DEFAULT_CHANNEL && !allowed[team.Name+"/"+channel.Name] {
+				errs.add(auth.removeChannelMember(team, channel, user))
+			}
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+const (
+	// defaultChangeAttribute is the operational attribute telling when an LDAP entry changed
+	defaultChangeAttribute = "modifyTimestamp"
+
+	// defaultFullSyncInterval is the maximum time between two full syncs if syncing incrementally
+	defaultFullSyncInterval = 24 * time.Hour
+
+	keyHighWaterMark = "high-water-mark"
+	keyLastFullSync  = "last-full-sync"
+)
+
+func (auth *AuthenticatorWithSync) changeAttribute() string {
+	if auth.syncConfig.ChangeAttribute == "" {
+		return defaultChangeAttribute
+	}
+
+	return auth.syncConfig.ChangeAttribute
+}
+
+// syncChanges runs an incremental sync if enabled, falling back to a full sync whenever one is due.
+// Nothing is polled while syncrepl sessions deliver the changes.
+func (auth *AuthenticatorWithSync) syncChanges() {
+	if auth.fullSyncDue() {
+		auth.syncAllOAuthUsers()
+		return
+	}
+
+	if auth.isListening() {
+		return
+	}
+
+	mark, err := auth.state.Get(bucketSync, keyHighWaterMark)
+	if !auth.syncConfig.Incremental || err != nil || mark == "" {
+		auth.syncAllOAuthUsers()
+		return
+	}
+
+	auth.startStats("incremental")
+	defer auth.finishStats()
+	auth.resetGroupGraph()
+
+	if err := auth.syncIncremental(mark); err != nil {
+		logging.Errorf("Error while syncing changed users: %+v", err)
+		auth.currentStats().failed(err)
+	}
+}
+
+// tracksChanges returns whether changes are synced between full syncs, either incrementally or via syncrepl
+func (auth *AuthenticatorWithSync) tracksChanges() bool {
+	return auth.syncConfig.Incremental || auth.syncConfig.Listen
+}
+
+// fullSyncDue returns whether a full sync has to be run instead of syncing changes only
+func (auth *AuthenticatorWithSync) fullSyncDue() bool {
+	if !auth.tracksChanges() {
+		return true
+	}
+
+	lastFullSync, err := auth.state.Get(bucketSync, keyLastFullSync)
+	if err != nil {
+		return true
+	}
+
+	last, err := time.Parse(time.RFC3339, lastFullSync)
+	return err != nil || time.Since(last) >= auth.fullSyncInterval
+}
+
+// syncIncremental syncs all users whose LDAP entry or group memberships changed since the given mark.
+// Users missing in LDAP are only deactivated by full syncs.
+func (auth *AuthenticatorWithSync) syncIncremental(mark string) error {
+	if err := auth.checkMattermostConnection(); err != nil {
+		return err
+	}
+
+	groupMembers, groupMark, err := auth.fetchGroupMembers(mark)
+	if err != nil {
+		return err
+	}
+
+	changedUsers, userMark, err := auth.authenticator.GetUsersChangedSince(auth.changeAttribute(), mark)
+	if err != nil {
+		return err
+	}
+
+	usersByUID := make(map[string]userData, len(changedUsers))
+	for _, user := range changedUsers {
+		usersByUID[strings.ToLower(user.(userData).UID)] = user.(userData)
+	}
+
+	failedUIDs, err := auth.state.Keys(bucketFailedUsers)
+	if err != nil {
+		return err
+	}
+
+	// users failing during previous runs are retried, the change mark has moved past them
+	for _, uid := range append(auth.changedGroupMembers(groupMembers), failedUIDs...) {
+		if _, found := usersByUID[strings.ToLower(uid)]; found {
+			continue
+		}
+
+		user, err := auth.authenticator.GetUserByID(uid)
+		if err == ldapauthenticator.ErrUserNotFound {
+			auth.recordUserResult(uid, nil)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		usersByUID[strings.ToLower(uid)] = user.(userData)
+	}
+
+	users := make([]userData, 0, len(usersByUID))
+	for _, user := range usersByUID {
+		users = append(users, user)
+	}
+
+	logging.Infof("Syncing %d changed users since %s.", len(users), mark)
+	auth.parallel(len(users), func(i int) {
+		auth.syncChangedUser(users[i])
+	})
+
+	newMark := ldapauthenticator.NewestChangeMark(mark, ldapauthenticator.NewestChangeMark(userMark, groupMark))
+	auth.saveIncrementalState(groupMembers, newMark, time.Time{})
+
+	return nil
+}
+
+// syncChangedUser syncs a changed LDAP user. Like the full sync, only users already known to Mattermost are synced.
+func (auth *AuthenticatorWithSync) syncChangedUser(data userData) {
+	mattermostUser, err := auth.findMattermostUser(data)
+	if err != nil {
+		logging.Errorf("Could not retrieve user from mattermost: %+v", err)
+		auth.recordUserResult(data.UID, err)
+		auth.currentStats().userSynced(err)
+		return
+	}
+	if mattermostUser == nil {
+		auth.recordUserResult(data.UID, nil)
+		return
+	}
+
+	logging.Infof("Syncing user %s with backend.", data.UID)
+	if err := auth.syncUser(data, mattermostUser); err != errUserDisabled {
+		auth.currentStats().userSynced(err)
+	}
+}
+
+// fetchGroupMembers returns the members of all groups changed since mark, or of all groups if mark is empty,
+// together with the newest change attribute value seen
+func (auth *AuthenticatorWithSync) fetchGroupMembers(mark string) (map[string][]string, string, error) {
+	schema := auth.groupSchema
+	filter := schema.filter(fmt.Sprintf("(%s=*)", schema.memberAttribute()))
+	if mark != "" {
+		// groups which lost their last member have to be found as well
+		filter = schema.filter(fmt.Sprintf("(%s>=%s)", auth.changeAttribute(), ldap.EscapeFilter(mark)))
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		auth.groupBaseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{schema.memberAttribute(), auth.changeAttribute()},
+		nil,
+	)
+
+	res, err := auth.authenticator.Connection().SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newestMark := mark
+	groups := make(map[string][]string, len(res.Entries))
+	for _, entry := range res.Entries {
+		members := entry.GetAttributeValues(schema.memberAttribute())
+		sort.Strings(members)
+		groups[entry.DN] = members
+
+		newestMark = ldapauthenticator.NewestChangeMark(newestMark, entry.GetAttributeValue(auth.changeAttribute()))
+	}
+
+	return groups, newestMark, nil
+}
+
+// changedGroupMembers returns the uids of all users who joined or left one of the given groups since the last sync
+func (auth *AuthenticatorWithSync) changedGroupMembers(groups map[string][]string) []string {
+	var uids []string
+	for dn, members := range groups {
+		stored, err := auth.state.Get(bucketGroupMembers, dn)
+		if err != nil {
+			logging.Errorf("Could not read members of group %s, got error: %+v", dn, err)
+			continue
+		}
+
+		previous := make(map[string]bool)
+		if stored != "" {
+			for _, member := range strings.Split(stored, "\n") {
+				previous[member] = true
+			}
+		}
+
+		var changed []string
+		for _, member := range members {
+			if previous[member] {
+				delete(previous, member)
+			} else {
+				changed = append(changed, member)
+			}
+		}
+		for member := range previous {
+			changed = append(changed, member)
+		}
+
+		for _, member := range changed {
+			if auth.groupSchema.nested && auth.isGroupDN(member) {
+				// a subgroup joined or left, all its members inherit the change
+				uids = append(uids, auth.nestedMemberUIDs(member)...)
+			} else if uid := auth.resolveMemberUID(member); uid != "" {
+				uids = append(uids, uid)
+			}
+		}
+	}
+
+	return uids
+}
+
+// uidFromDN returns the lower cased uid of a member DN like uid=jdoe,ou=people,dc=example,dc=org
+func uidFromDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+
+	for _, attribute := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attribute.Type, "uid") {
+			return strings.ToLower(attribute.Value)
+		}
+	}
+
+	return ""
+}
+
+// saveIncrementalState stores the group members and the high-water mark after a successful run.
+// fullSync is the start of a full sync and zero for incremental syncs.
+func (auth *AuthenticatorWithSync) saveIncrementalState(groups map[string][]string, mark string, fullSync time.Time) {
+	if auth.dryRun {
+		return
+	}
+
+	for dn, members := range groups {
+		if err := auth.storeGroupMembers(dn, members); err != nil {
+			logging.Errorf("Could not store members of group %s, got error: %+v", dn, err)
+			return
+		}
+	}
+
+	if !fullSync.IsZero() {
+		auth.pruneGroupMembers(groups)
+
+		if err := auth.state.Set(bucketSync, keyLastFullSync, fullSync.Format(time.RFC3339)); err != nil {
+			logging.Errorf("Could not store the time of the full sync, got error: %+v", err)
+			return
+		}
+	}
+
+	if mark == "" {
+		return
+	}
+
+	if err := auth.state.Set(bucketSync, keyHighWaterMark, mark); err != nil {
+		logging.Errorf("Could not store the high-water mark, got error: %+v", err)
+	}
+}
+
+// pruneGroupMembers forgets the member lists of all groups missing in groups, which holds every group seen by a full sync
+func (auth *AuthenticatorWithSync) pruneGroupMembers(groups map[string][]string) {
+	stored, err := auth.state.Keys(bucketGroupMembers)
+	if err != nil {
+		logging.Errorf("Could not read the stored groups, got error: %+v", err)
+		return
+	}
+
+	for _, dn := range stored {
+		if _, found := groups[dn]; found {
+			continue
+		}
+
+		if err := auth.state.Delete(bucketGroupMembers, dn); err != nil {
+			logging.Errorf("Could not forget members of group %s, got error: %+v", dn, err)
+		}
+	}
+}
+
+// storeGroupMembers remembers the sorted member list of the group for the next diff
+func (auth *AuthenticatorWithSync) storeGroupMembers(dn string, members []string) error {
+	if len(members) == 0 {
+		return auth.state.Delete(bucketGroupMembers, dn)
+	}
+
+	return auth.state.Set(bucketGroupMembers, dn, strings.Join(members, "\n"))
+}
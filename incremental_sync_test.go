@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestUIDFromDN(t *testing.T) {
+	tests := []struct {
+		dn       string
+		expected string
+	}{
+		{"uid=jdoe,ou=people,dc=example,dc=org", "jdoe"},
+		{"UID=JDoe,ou=people,dc=example,dc=org", "jdoe"},
+		{"uid=jdoe+cn=John Doe,ou=people,dc=example,dc=org", "jdoe"},
+		{"cn=John Doe,ou=people,dc=example,dc=org", ""},
+		{"ou=people,uid=jdoe,dc=example,dc=org", ""},
+		{"not a dn", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if actual := uidFromDN(test.dn); actual != test.expected {
+			t.Errorf("uidFromDN(%q) = %q, expected %q", test.dn, actual, test.expected)
+		}
+	}
+}
+
+func TestChangedGroupMembers(t *testing.T) {
+	const groupA = "ou=a,ou=groups,dc=example,dc=org"
+	const groupB = "ou=b,ou=groups,dc=example,dc=org"
+
+	tests := []struct {
+		name     string
+		stored   map[string][]string
+		current  map[string][]string
+		expected []string
+	}{
+		{
+			"unchanged",
+			map[string][]string{groupA: {"uid=alice,dc=example,dc=org", "uid=bob,dc=example,dc=org"}},
+			map[string][]string{groupA: {"uid=bob,dc=example,dc=org", "uid=alice,dc=example,dc=org"}},
+			nil,
+		},
+		{
+			"joined and left",
+			map[string][]string{groupA: {"uid=alice,dc=example,dc=org", "uid=bob,dc=example,dc=org"}},
+			map[string][]string{groupA: {"uid=bob,dc=example,dc=org", "uid=Carol,dc=example,dc=org"}},
+			[]string{"alice", "carol"},
+		},
+		{
+			"new group",
+			nil,
+			map[string][]string{groupB: {"uid=dave,dc=example,dc=org"}},
+			[]string{"dave"},
+		},
+		{
+			"emptied group",
+			map[string][]string{groupA: {"uid=alice,dc=example,dc=org"}},
+			map[string][]string{groupA: nil},
+			[]string{"alice"},
+		},
+		{
+			"several groups",
+			map[string][]string{groupA: {"uid=alice,dc=example,dc=org"}, groupB: {"uid=bob,dc=example,dc=org"}},
+			map[string][]string{groupA: {"uid=alice,dc=example,dc=org", "uid=bob,dc=example,dc=org"}, groupB: {"uid=bob,dc=example,dc=org"}},
+			[]string{"bob"},
+		},
+	}
+
+	for _, test := range tests {
+		auth := NewAuthenticatorWithSync("", "", "", "", "", Transformer{})
+		for dn, members := range test.stored {
+			if err := auth.storeGroupMembers(dn, members); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		actual := auth.changedGroupMembers(test.current)
+		sort.Strings(actual)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: changedGroupMembers = %v, expected %v", test.name, actual, test.expected)
+		}
+	}
+}
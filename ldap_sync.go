@@ -1,19 +1,28 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"log"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-ldap/ldap"
 	"github.com/mattermost/mattermost-server/model"
 	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/oauthenticator"
 )
 
 type group struct {
-	uid  string
-	name string
+	uid         string
+	name        string
+	description string
+	dn          string
+	// nested is set if the user is only a member of one of the group's subgroups
+	nested bool
 }
 
 // AuthenticatorWithSync composes ldapauthenticator.Authenticator with mattermost and syncs groups and users
@@ -24,15 +33,80 @@ type AuthenticatorWithSync struct {
 	groupMemberQuery string
 	groupBaseDn      string
 
-	mattermostClient *model.Client4
+	mattermost *mattermostConnection
 
 	mattermostURL      string
 	mattermostUsername string
 	mattermostPassword string
+	mattermostToken    string
+
+	// authService is the Mattermost auth service emulated by this server
+	authService          string
+	previousAuthServices []string
 
 	transformer Transformer
+
+	syncConfig  SyncConfig
+	gracePeriod time.Duration
+	// teamArchiveGracePeriod is how long the group of a team has to be gone before the team is archived
+	teamArchiveGracePeriod time.Duration
+	// fullSyncInterval is the maximum time between two full syncs if syncing incrementally
+	fullSyncInterval time.Duration
+	teamPolicy       teamPolicy
+	teamTemplate     teamTemplate
+	groupSchema      groupSchema
+
+	channelMappings []channelMapping
+	// userGroupMappings mirror LDAP groups as Mattermost user groups, userGroupMembers collects their members during a full sync
+	userGroupMappings []userGroupMapping
+	userGroupMembers  *userGroupMembers
+
+	rolesConfig     RolesConfig
+	teamAdminGroups map[string][]string
+	teamAdminDirect map[string]bool
+
+	// state persists the sync state between runs
+	state stateStore
+
+	pictureSize  int
+	pictureCache *pictureCache
+	// avatarURL is the base URL the profile pictures are served at, avatarSecret signs the ids in the URLs
+	avatarURL    string
+	avatarSecret []byte
+
+	// mattermostIndex maps the AuthData of all OAuth users to their Mattermost ids, built by every full sync
+	mattermostIndex *userIndex
+
+	// dryRun only records the changes to plan without applying them
+	dryRun bool
+	plan   *syncPlan
+
+	// stats of the current or last sync run, runMutex guards replacing stats and plan while users are synced
+	stats    *syncStats
+	runMutex *sync.RWMutex
+	// reportConfig tells where to post the summary of every run
+	reportConfig ReportConfig
+
+	// groupGraph caches all groups of the current run to resolve nested groups
+	groupGraph *groupGraph
+	// memberUIDs caches the uids of member DNs looked up during the current run
+	memberUIDs map[string]string
+	graphMutex *sync.Mutex
+
+	// listenSessions is the number of syncrepl sessions opened by listenForChanges, listening the number of those up
+	listenSessions int32
+	listening      int32
+
+	// running is set while a full or incremental sync runs, preventing overlapping runs
+	running int32
+
+	// creationMutex serializes creating teams and channels between the sync workers
+	creationMutex *sync.Mutex
 }
 
+// errUserDisabled is returned by the sync if the LDAP entry has been flagged disabled
+var errUserDisabled = errors.New("user is disabled")
+
 // NewAuthenticatorWithSync creates a new authenticator with Mattermost syncing functionality
 func NewAuthenticatorWithSync(bindDn, bindPassword, queryDn, groupMemberQuery, groupBaseDn string, transformer Transformer) AuthenticatorWithSync {
 	var syncAuther AuthenticatorWithSync
@@ -44,10 +118,127 @@ func NewAuthenticatorWithSync(bindDn, bindPassword, queryDn, groupMemberQuery, g
 	syncAuther.groupBaseDn = groupBaseDn
 
 	syncAuther.transformer = transformer
+	syncAuther.state = &fileStateStore{state: make(map[string]map[string]string)}
+	syncAuther.mattermostIndex = &userIndex{}
+	syncAuther.authService = model.USER_AUTH_SERVICE_GITLAB
+	syncAuther.mattermost = &mattermostConnection{limiter: newRateLimiter(0, 1)}
+	syncAuther.plan = newSyncPlan()
+	syncAuther.teamTemplate = newTeamTemplate()
+	syncAuther.groupSchema = newGroupSchema()
+	syncAuther.stats = newSyncStats("full", syncAuther.mattermost.limiter)
+	syncAuther.creationMutex = &sync.Mutex{}
+	syncAuther.graphMutex = &sync.Mutex{}
+	syncAuther.runMutex = &sync.RWMutex{}
+	syncAuther.pictureCache = &pictureCache{}
 
 	return syncAuther
 }
 
+// ConfigureSync applies the given sync configuration
+func (auth *AuthenticatorWithSync) ConfigureSync(config SyncConfig) error {
+	if config.DeactivationGracePeriod != "" {
+		gracePeriod, err := time.ParseDuration(config.DeactivationGracePeriod)
+		if err != nil {
+			return err
+		}
+
+		auth.gracePeriod = gracePeriod
+	}
+
+	if config.TeamArchiveGracePeriod != "" {
+		gracePeriod, err := time.ParseDuration(config.TeamArchiveGracePeriod)
+		if err != nil {
+			return err
+		}
+
+		auth.teamArchiveGracePeriod = gracePeriod
+	}
+
+	auth.fullSyncInterval = defaultFullSyncInterval
+	if config.FullSyncInterval != "" {
+		interval, err := time.ParseDuration(config.FullSyncInterval)
+		if err != nil {
+			return err
+		}
+
+		auth.fullSyncInterval = interval
+	}
+
+	if err := validateSchedules(config); err != nil {
+		return err
+	}
+
+	policy, err := newTeamPolicy(config)
+	if err != nil {
+		return err
+	}
+
+	auth.syncConfig = config
+	auth.teamPolicy = policy
+	auth.mattermost.limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+
+	return nil
+}
+
+// SetStateStore sets the store persisting the sync state between runs
+func (auth *AuthenticatorWithSync) SetStateStore(state stateStore) {
+	auth.state = state
+}
+
+// ConfigurePictures sets the size of synced profile pictures, the base URL they are served at and the secret signing their URLs
+func (auth *AuthenticatorWithSync) ConfigurePictures(size int, avatarURL, secret string) error {
+	auth.pictureSize = size
+	auth.avatarURL = avatarURL
+	auth.avatarSecret = []byte(secret)
+
+	if avatarURL != "" && secret == "" {
+		auth.avatarSecret = make([]byte, 32)
+		if _, err := rand.Read(auth.avatarSecret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetDryRun enables or disables the dry-run mode in which no changes are applied to Mattermost
+func (auth *AuthenticatorWithSync) SetDryRun(dryRun bool) {
+	auth.dryRun = dryRun
+}
+
+// Plan returns the changes of the current or last sync run
+func (auth *AuthenticatorWithSync) Plan() *syncPlan {
+	auth.runMutex.RLock()
+	defer auth.runMutex.RUnlock()
+
+	return auth.plan
+}
+
+// resetPlan starts an empty plan outside of sync runs
+func (auth *AuthenticatorWithSync) resetPlan() {
+	auth.runMutex.Lock()
+	defer auth.runMutex.Unlock()
+
+	auth.plan = newSyncPlan()
+}
+
+// changeFailed drops a planned change from the plan since applying it failed, so only applied changes are reported
+func (auth *AuthenticatorWithSync) changeFailed(action, user, target string) {
+	auth.Plan().drop(action, user, target)
+}
+
+// planChange records the change and returns whether it should actually be applied.
+// Callers drop the change with changeFailed if applying it fails.
+func (auth *AuthenticatorWithSync) planChange(action, user, target, detail string) bool {
+	auth.Plan().record(action, user, target, detail)
+
+	if auth.dryRun {
+		logging.Infof("Dry-run: %s %s %s %s", action, user, target, detail)
+	}
+
+	return !auth.dryRun
+}
+
 // Connect to bindUrl LDAP server
 func (auth *AuthenticatorWithSync) Connect(bindURL string) error {
 	return auth.authenticator.Connect(bindURL)
@@ -60,42 +251,75 @@ func (auth *AuthenticatorWithSync) Close() {
 
 // ConnectMattermost connects to the given mattermost instance
 func (auth *AuthenticatorWithSync) ConnectMattermost(url, username, password string) error {
-	auth.mattermostClient = model.NewAPIv4Client(url)
-	_, resp := auth.mattermostClient.Login(username, password)
+	client := newMattermostClient(url)
+	_, resp := client.Login(username, password)
+	auth.mattermost.set(client)
 
 	auth.mattermostURL = url
 	auth.mattermostUsername = username
 	auth.mattermostPassword = password
 
 	if resp.Error != nil {
-		log.Printf("Got error during login: %+v\n", resp.Error)
+		logging.Infof("Got error during login: %+v", resp.Error)
 		return resp.Error
 	}
 
 	return nil
 }
 
-// Mattermost returns the current valid mattermost connection
+// ConnectMattermostWithToken connects to the given mattermost instance using a personal access or bot token
+func (auth *AuthenticatorWithSync) ConnectMattermostWithToken(url, token string) error {
+	client := newMattermostClient(url)
+	client.SetOAuthToken(token)
+	auth.mattermost.set(client)
+
+	auth.mattermostURL = url
+	auth.mattermostToken = token
+
+	// verify the token
+	if _, resp := client.GetMe(""); resp.Error != nil {
+		logging.Infof("Got error verifying the token: %+v", resp.Error)
+		return resp.Error
+	}
+
+	return nil
+}
+
+// Mattermost returns the mattermost connection once the rate limit allows another API call
 func (auth *AuthenticatorWithSync) Mattermost() *model.Client4 {
-	if _, resp := auth.mattermostClient.GetPing(); resp.Error != nil {
-		// Ping was not successful, retry to connect
-		if err := auth.ReconnectMattermost(10); err != nil {
-			// Reconnect was not successful, there is something more troublesome going on...
-			panic(err)
+	auth.mattermost.limiter.wait()
+
+	return auth.mattermost.get()
+}
+
+// checkMattermostConnection pings mattermost and reconnects if necessary
+func (auth *AuthenticatorWithSync) checkMattermostConnection() error {
+	if _, resp := auth.Mattermost().GetPing(); resp.Error == nil {
+		if _, resp := auth.Mattermost().GetMe(""); resp.Error == nil {
+			return nil
 		}
 	}
 
-	return auth.mattermostClient
+	// Ping was not successful or the session expired, retry to connect
+	return auth.ReconnectMattermost(10)
 }
 
 // ReconnectMattermost tries to reconnect to mattermost within maxReconnectCount times
 func (auth *AuthenticatorWithSync) ReconnectMattermost(maxReconnectCount uint) error {
-	if err := auth.ConnectMattermost(auth.mattermostURL, auth.mattermostUsername, auth.mattermostPassword); err != nil {
-		log.Printf("Could not connect to mattermost: %+v\n", err)
+	connect := func() error {
+		if auth.mattermostToken != "" {
+			return auth.ConnectMattermostWithToken(auth.mattermostURL, auth.mattermostToken)
+		}
+
+		return auth.ConnectMattermost(auth.mattermostURL, auth.mattermostUsername, auth.mattermostPassword)
+	}
+
+	if err := connect(); err != nil {
+		logging.Errorf("Could not connect to mattermost: %+v", err)
 		// login was not successful
-		if maxReconnectCount >= 0 {
+		if maxReconnectCount > 0 {
 			// but we have some more tries to go
-			log.Println("Retrying to connect to mattermost")
+			logging.Infof("Retrying to connect to mattermost")
 			return auth.ReconnectMattermost(maxReconnectCount - 1)
 		}
 
@@ -105,78 +329,211 @@ func (auth *AuthenticatorWithSync) ReconnectMattermost(maxReconnectCount uint) e
 	return nil // sucessful connection
 }
 
-// GetUserByID from LDAP
-func (auth AuthenticatorWithSync) GetUserByID(id string) (interface{}, error) {
-	return auth.authenticator.GetUserByID(id)
+// GetUserByID from LDAP, shaped like the user info response of the emulated auth service
+func (auth *AuthenticatorWithSync) GetUserByID(id string) (interface{}, error) {
+	user, err := auth.authenticator.GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data := user.(userData)
+	if auth.avatarURL != "" && auth.transformer.PictureAttrName != "" {
+		// users without a picture get a 404 at the URL, loading the picture for every request would be too expensive
+		data.AvatarURL = auth.avatarURL + url.PathEscape(auth.avatarID(data.UID))
+	}
+
+	return data.forService(auth.authService), nil
 }
 
-// Authenticate user with password at LDAP
-func (auth AuthenticatorWithSync) Authenticate(username, password string) (string, error) {
+// Authenticate user with password at LDAP. Unknown users, wrong passwords and disabled users
+// are reported as oauthenticator.ErrInvalidCredentials.
+func (auth *AuthenticatorWithSync) Authenticate(username, password string) (string, error) {
 	uid, err := auth.authenticator.Authenticate(username, password)
+	if err == ldapauthenticator.ErrUserNotFound || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) || ldap.IsErrorWithCode(err, ldap.ErrorEmptyPassword) {
+		return "", oauthenticator.ErrInvalidCredentials
+	}
 	if err != nil {
 		return "", err
 	}
 
-	auth.syncMattermostForUser(uid)
+	if err := auth.syncMattermostForUser(uid); err == errUserDisabled {
+		return "", oauthenticator.ErrInvalidCredentials
+	}
 
 	return uid, nil
 }
 
-func (auth *AuthenticatorWithSync) fetchGroupsForUser(uid string) []group {
+// fetchGroupsForUser returns the groups of the user including the ones they inherit from nested groups.
+// Memberships must never be changed after an error, the groups would be incomplete.
+func (auth *AuthenticatorWithSync) fetchGroupsForUser(uid string) ([]group, error) {
+	groups, err := auth.searchGroupsForUser(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.expandGroups(groups)
+}
+
+// fetchAllGroups returns all groups below the group base DN, including groups without members
+func (auth *AuthenticatorWithSync) fetchAllGroups() ([]group, error) {
+	return auth.searchGroups(auth.groupSchema.filter("(objectClass=*)"))
+}
+
+func (auth *AuthenticatorWithSync) searchGroups(filter string) ([]group, error) {
+	return auth.searchGroupsIn(auth.groupBaseDn, ldap.ScopeWholeSubtree, filter)
+}
+
+func (auth *AuthenticatorWithSync) searchGroupsIn(baseDn string, scope int, filter string) ([]group, error) {
 	conn := auth.authenticator.Connection()
 
-	filter := fmt.Sprintf(auth.groupMemberQuery, uid, auth.userDn)
 	searchRequest := ldap.NewSearchRequest(
-		auth.groupBaseDn, // The base dn to search
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		filter, // The filter to apply
-		// TODO make more generic
-		[]string{"dn", "cn", "ou"}, // A list attributes to retrieve
+		baseDn, // The base dn to search
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		filter,                        // The filter to apply
+		auth.groupSchema.attributes(), // A list attributes to retrieve
 		nil,
 	)
 
-	res, err := conn.Search(searchRequest)
+	res, err := conn.SearchWithPaging(searchRequest, 500)
 	if err != nil {
-		log.Printf("ERROR: %+v\n", err)
-		return []group{}
+		return nil, err
 	}
 
-	entries := res.Entries
 	var groups []group
-	for _, entry := range entries {
-		// TODO make more generic
-		group := group{uid: entry.GetAttributeValue("ou"), name: entry.GetAttributeValue("cn")}
-		groups = append(groups, group)
+	for _, entry := range res.Entries {
+		groups = append(groups, auth.groupSchema.toGroup(entry))
 	}
 
-	return groups
+	return groups, nil
 }
 
-func (auth *AuthenticatorWithSync) syncMattermostForUser(uid string) {
-	user, err := auth.GetUserByID(uid)
+// syncMattermostForUser syncs the LDAP user with the given uid to Mattermost. It returns
+// ldapauthenticator.ErrUserNotFound or errUserDisabled if the user should not have access anymore.
+func (auth *AuthenticatorWithSync) syncMattermostForUser(uid string) error {
+	if err := auth.checkMattermostConnection(); err != nil {
+		logging.Errorf("%+v", err)
+		return err
+	}
+
+	user, err := auth.authenticator.GetUserByID(uid)
 	if err != nil {
-		log.Printf("ERROR: %+v\n", err)
-		return
+		logging.Errorf("%+v", err)
+		return err
 	}
 
-	if strings.Index(user.(userData).Username, uid) < 0 {
-		log.Printf("ERROR: Invalid state. Got uid %s but userData %+v\n", uid, user)
-		return
+	if !strings.EqualFold(user.(userData).UID, uid) {
+		logging.Errorf("Invalid state. Got uid %s but userData %+v", uid, user)
+		return errors.New("invalid user state")
 	}
 
-	mattermostUser, mmErr := auth.Mattermost().GetUserByEmail(user.(userData).Email, "")
-	if mmErr.Error != nil {
-		log.Printf("Could not retrieve user from mattermost: %+v\n", mmErr.Error)
-		return
+	return auth.syncUser(user.(userData), nil)
+}
+
+// syncUser syncs the given LDAP user to Mattermost. If mattermostUser is nil it is looked up by its AuthData.
+// Users who did not change since their last sync without changes are skipped.
+func (auth *AuthenticatorWithSync) syncUser(data userData, mattermostUser *model.User) (err error) {
+	defer func() { auth.recordUserResult(data.UID, err) }()
+
+	if !data.isActive() {
+		logging.Infof("User %s is disabled in LDAP, skipping sync.", data.UID)
+		return errUserDisabled
+	}
+
+	if mattermostUser == nil {
+		if mattermostUser, err = auth.findMattermostUser(data); err != nil {
+			logging.Errorf("Could not retrieve user from mattermost: %+v", err)
+			return err
+		}
+	}
+
+	groups, err := auth.fetchGroupsForUser(data.UID)
+	if err != nil {
+		logging.Errorf("Could not fetch the groups of user %s, skipping sync: %+v", data.UID, err)
+		return err
+	}
+
+	if mattermostUser == nil {
+		return auth.applyUser(data, nil, groups)
+	}
+
+	hash := auth.userHash(data, groups, mattermostUser)
+	if auth.isUnchanged(mattermostUser, hash) {
+		auth.currentStats().userSkipped()
+		auth.expectUserGroupMembers(mattermostUser, groups)
+		return nil
 	}
 
-	auth.checkMattermostUser(user.(userData).ID, mattermostUser.Username, user.(userData).Name, mattermostUser.Email)
+	changes := auth.Plan().CountFor(mattermostUser.Username, data.Username)
+	if err := auth.applyUser(data, mattermostUser, groups); err != nil {
+		return err
+	}
+
+	auth.storeUserHash(mattermostUser, hash, auth.Plan().CountFor(mattermostUser.Username, data.Username) != changes)
+	auth.expectUserGroupMembers(mattermostUser, groups)
+
+	return nil
+}
+
+// syncErrors collects the errors of the steps of a user's sync, so a failing step does not stop the others
+type syncErrors []error
+
+func (errs *syncErrors) add(err error) {
+	if err != nil {
+		*errs = append(*errs, err)
+	}
+}
+
+// err returns nil if all steps succeeded
+func (errs syncErrors) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%d errors: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// applyUser creates or updates the Mattermost user and syncs their teams, channels and roles.
+// It returns the errors of all failed steps.
+func (auth *AuthenticatorWithSync) applyUser(data userData, mattermostUser *model.User, groups []group) error {
+	mattermostUser, err := auth.checkMattermostUser(data, mattermostUser)
+	if mattermostUser == nil {
+		// the user has not been created, either due to an error, a conflict or the dry-run
+		return err
+	}
+
+	logger := logging.With("user", mattermostUser.Username)
+
+	// a failed patch still syncs the memberships of the unchanged user
+	var errs syncErrors
+	errs.add(err)
+	errs.add(auth.checkAuthService(mattermostUser))
+
+	if mattermostUser.DeleteAt != 0 {
+		errs.add(auth.reactivateMattermostUser(mattermostUser))
+	}
+
+	errs.add(auth.syncPictureForUser(mattermostUser, data))
+
+	// guests only join the teams of their mapped channels
+	teamGroups := groups
+	guest, err := auth.syncGuestForUser(mattermostUser, groups)
+	errs.add(err)
+	if guest {
+		teamGroups = nil
+	}
 
-	groups := auth.fetchGroupsForUser(uid)
 	mattermostGroups, mmErr := auth.Mattermost().GetTeamsForUser(mattermostUser.Id, "")
 	if mmErr.Error != nil {
-		log.Printf("Could not retrieve groups for user %s from mattermost: %+v\n", mattermostUser.Username, mmErr.Error)
-		return
+		logger.Errorf("Could not retrieve groups for user %s from mattermost: %+v", mattermostUser.Username, mmErr.Error)
+		errs.add(mmErr.Error)
+		return errs.err()
 	}
 
 	var mattermostTeamNames []string
@@ -184,30 +541,57 @@ func (auth *AuthenticatorWithSync) syncMattermostForUser(uid string) {
 		mattermostTeamNames = append(mattermostTeamNames, team.Name)
 	}
 
-	log.Printf("Comparing [ldap: %+v] vs. [mattermost: %+v]", groups, mattermostTeamNames)
+	logger.Debugf("Comparing [ldap: %+v] vs. [mattermost: %+v]", groups, mattermostTeamNames)
 
 	// check which groups we need to add
-	for _, group := range groups {
+	for _, group := range teamGroups {
 		found := false
+		teamName := auth.teamNameForGroup(group.uid)
 		for index, mmGroup := range mattermostGroups {
-			if auth.normalizeGroupName(group.uid) == mmGroup.Name {
+			if teamName == mmGroup.Name {
 				// user already in group, delete entry from mattermost array. No need to consider it further
 				found = true
+				// memberships backed by LDAP are adopted, so they are removed once the user leaves the group
+				auth.markManaged(bucketManagedTeamMember, mmGroup.Id, mattermostUser.Id)
 				mattermostGroups = append(mattermostGroups[:index], mattermostGroups[index+1:]...)
 				break
 			}
 		}
 
-		if !found {
-			auth.checkGroupForMattermostUser(group, mattermostUser.Email)
+		if !found && auth.teamPolicy.mayAdd(teamName) {
+			errs.add(auth.checkGroupForMattermostUser(group, mattermostUser))
 		}
 	}
 
+	channelTeams := auth.channelTeamsForUser(groups)
 	for _, group := range mattermostGroups {
-		// all these remaining groups could not be matched against a ldap group. remove the user!
+		// all these remaining groups could not be matched against a ldap group. remove the user if the policy allows it!
+		if !auth.teamPolicy.mayRemove(group) || channelTeams[group.Name] {
+			continue
+		}
+
+		// memberships added by admins are left alone
+		if !auth.isManaged(bucketManagedTeamMember, group.Id, mattermostUser.Id) {
+			continue
+		}
+
+		if !auth.planChange(actionRemoveTeamMember, mattermostUser.Username, group.Name, "") {
+			continue
+		}
+
 		if _, mmErr := auth.Mattermost().RemoveTeamMember(group.Id, mattermostUser.Id); mmErr.Error != nil {
-			log.Printf("Could not remove user %s from team %s:%+v\n", mattermostUser.Username, group.Name, mmErr.Error)
+			logger.With("team", group.Name).Errorf("Could not remove user %s from team %s:%+v", mattermostUser.Username, group.Name, mmErr.Error)
+			auth.changeFailed(actionRemoveTeamMember, mattermostUser.Username, group.Name)
+			errs.add(mmErr.Error)
+			continue
 		}
+
+		auth.forgetManaged(bucketManagedTeamMember, group.Id, mattermostUser.Id)
 	}
 
+	errs.add(auth.syncChannelsForUser(mattermostUser, groups))
+	errs.add(auth.syncUserGroupsForUser(mattermostUser, groups))
+	errs.add(auth.syncRolesForUser(mattermostUser, groups))
+
+	return errs.err()
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"strings"
 
 	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
 )
@@ -11,43 +12,134 @@ import (
 type Transformer struct {
 	UsernamePrefix string
 
-	MailAttrName string
-	CNAttrName   string
-	UIDAttrName  string
+	UIDAttrName string
+	// IDAttrName is an immutable attribute the Mattermost AuthData is derived from, uid if empty
+	IDAttrName string
+
+	// Mapping of the user fields onto LDAP attributes
+	Mapping userMapping
+
+	// PictureAttrName holds the binary profile picture, e.g. jpegPhoto or thumbnailPhoto.
+	// It is only loaded on demand, changes are detected by ChangeAttrName instead.
+	PictureAttrName string
+	// ChangeAttrName tells when an LDAP entry changed, modifyTimestamp if empty
+	ChangeAttrName string
+
+	// DisabledAttrName flags a user as disabled. If DisabledValues is empty the mere presence
+	// of the attribute disables the user, otherwise one of its values has to match.
+	DisabledAttrName string
+	DisabledValues   []string
 
 	AdditionalSelectors []string
 }
 
 // Selectors used by the transformer
 func (transformer Transformer) Selectors() []string {
-	return append(transformer.AdditionalSelectors, transformer.MailAttrName, transformer.CNAttrName, transformer.UIDAttrName)
+	selectors := append([]string{}, transformer.AdditionalSelectors...)
+	selectors = append(selectors, transformer.Mapping.selectors()...)
+	selectors = append(selectors, transformer.UIDAttrName, transformer.idAttrName())
+	if transformer.PictureAttrName != "" {
+		selectors = append(selectors, transformer.changeAttrName())
+	}
+	if transformer.DisabledAttrName != "" {
+		selectors = append(selectors, transformer.DisabledAttrName)
+	}
+
+	return selectors
 }
 
 // Transform performs the actual tranformation
 func (transformer Transformer) Transform(entry *ldapauthenticator.Entry) interface{} {
 	user := newUserData()
 
-	for _, attr := range entry.Attributes {
-		if attr.Name == transformer.MailAttrName {
-			user.Email = attr.Values[0]
-		}
+	user.UID = attributeValue(entry, transformer.UIDAttrName)
+	if id := attributeValue(entry, transformer.idAttrName()); id != "" {
+		// create a int64 hash sum to generate a user id from the immutable id attribute
+		// this is technically important in order to be compatible to mattermost
+		h := sha256.New()
+		h.Write([]byte(id))
+		user.ID = int64(binary.BigEndian.Uint64(h.Sum(nil)))
+	}
 
-		if attr.Name == transformer.CNAttrName {
-			user.Name = attr.Values[0]
+	// generate user name from the mapped attribute, uid by default
+	if username := transformer.Mapping.Username.value(entry); username != "" {
+		user.Username = transformer.UsernamePrefix + username
+	}
+
+	user.Email = transformer.Mapping.Email.value(entry)
+	user.Name = transformer.Mapping.Name.value(entry)
+	user.FirstName = transformer.Mapping.FirstName.value(entry)
+	user.LastName = transformer.Mapping.LastName.value(entry)
+	user.Nickname = transformer.Mapping.Nickname.value(entry)
+	user.Position = transformer.Mapping.Position.value(entry)
+	user.Locale = transformer.Mapping.Locale.value(entry)
+
+	if !transformer.Mapping.FirstName.isSet() && !transformer.Mapping.LastName.isSet() {
+		// without explicit mapping split the name on its first space
+		names := strings.SplitN(user.Name, " ", 2)
+		user.FirstName = names[0]
+		if len(names) > 1 {
+			user.LastName = names[1]
 		}
+	} else if user.Name == "" {
+		user.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
 
-		if attr.Name == transformer.UIDAttrName {
-			// create a int64 hash sum to generate a user id from uid
-			// this is technically important in order to be compatible to mattermost
-			uid := attr.Values[0]
-			h := sha256.New()
-			h.Write([]byte(uid))
-			user.ID = int64(binary.BigEndian.Uint64(h.Sum(nil)))
+	if transformer.PictureAttrName != "" {
+		user.Modified = attributeValue(entry, transformer.changeAttrName())
+	}
 
-			// generate user name from uid
-			user.Username = transformer.UsernamePrefix + attr.Values[0]
+	if transformer.DisabledAttrName != "" {
+		for _, attr := range entry.Attributes {
+			if strings.EqualFold(attr.Name, transformer.DisabledAttrName) && transformer.isDisabled(attr.Values) {
+				user.State = userStateBlocked
+			}
 		}
 	}
 
 	return user
 }
+
+// picture returns the raw profile picture of the entry or nil if it has none
+func (transformer Transformer) picture(entry *ldapauthenticator.Entry) []byte {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, transformer.PictureAttrName) && len(attr.ByteValues) > 0 {
+			return attr.ByteValues[0]
+		}
+	}
+
+	return nil
+}
+
+func (transformer Transformer) changeAttrName() string {
+	if transformer.ChangeAttrName == "" {
+		return defaultChangeAttribute
+	}
+
+	return transformer.ChangeAttrName
+}
+
+func (transformer Transformer) idAttrName() string {
+	if transformer.IDAttrName == "" {
+		return transformer.UIDAttrName
+	}
+
+	return transformer.IDAttrName
+}
+
+// isDisabled checks the values of the disabled attribute against the configured DisabledValues
+func (transformer Transformer) isDisabled(values []string) bool {
+	if len(transformer.DisabledValues) == 0 {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		for _, disabled := range transformer.DisabledValues {
+			if strings.EqualFold(value, disabled) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
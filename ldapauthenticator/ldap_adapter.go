@@ -4,14 +4,19 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"sync"
 
 	"github.com/go-ldap/ldap"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
 )
 
 // Entry is a synonyme to go-ldap/ldap Entry
 type Entry = ldap.Entry
 
+// ErrUserNotFound is returned if there is no user with the given uid below the query DN
+var ErrUserNotFound = errors.New("user does not exist")
+
 // Authenticator holds the connection to the LDAP server as well as a given transformer to process retrieved entries.
 type Authenticator struct {
 	bindURL      string
@@ -20,7 +25,9 @@ type Authenticator struct {
 	queryDN      string
 	selectors    []string
 
-	conn *ldap.Conn
+	// conn is bound as bindDN and shared by all searches, connMutex guards reconnecting it
+	conn      *Conn
+	connMutex *sync.Mutex
 
 	transformer Transformer
 }
@@ -33,43 +40,71 @@ func NewAuthenticator(bindDN, bindPassword, queryDN string, transformer Transfor
 	authenticator.bindPassword = bindPassword
 	authenticator.queryDN = queryDN
 	authenticator.transformer = transformer
+	authenticator.connMutex = &sync.Mutex{}
 
 	authenticator.selectors = transformer.Selectors()
 
 	return authenticator
 }
 
-// Connection returns the current ldap connection
-func (auth *Authenticator) Connection() *ldap.Conn {
+// Connection returns the current ldap connection bound as bindDN. It is never bound as another user,
+// so it can be used by several goroutines at once.
+func (auth *Authenticator) Connection() *Conn {
+	auth.connMutex.Lock()
+	defer auth.connMutex.Unlock()
+
 	if auth.conn.IsClosing() {
-		if err := auth.Connect(auth.bindURL); err != nil {
+		if err := auth.connect(auth.bindURL); err != nil {
 			// could not reconnect automatically.
-			log.Fatal(err)
+			logging.Fatal(err)
 		}
 	}
 
 	return auth.conn
 }
 
-// Connect to bindURL ldap server and upgrade to TLS
+// Connect to bindURL ldap server, upgrade to TLS and bind as bindDN
 func (auth *Authenticator) Connect(bindURL string) error {
-	l, err := ldap.DialURL(bindURL)
+	auth.connMutex.Lock()
+	defer auth.connMutex.Unlock()
+
+	return auth.connect(bindURL)
+}
+
+func (auth *Authenticator) connect(bindURL string) error {
+	conn, err := dial(bindURL)
 	if err != nil {
 		return err
 	}
 
-	// Upgrade connection to TLS
-	err = l.StartTLS(&tls.Config{InsecureSkipVerify: true})
-	if err != nil {
+	if err := conn.Bind(auth.bindDN, auth.bindPassword); err != nil {
+		conn.Close()
 		return err
 	}
 
-	auth.conn = l
+	auth.conn = conn
 	auth.bindURL = bindURL
 
 	return nil
 }
 
+// dial opens a connection to the ldap server upgraded to TLS
+func dial(bindURL string) (*Conn, error) {
+	l, err := ldap.DialURL(bindURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upgrade connection to TLS
+	err = l.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &Conn{Conn: l}, nil
+}
+
 // Close the ldap connection
 func (auth *Authenticator) Close() {
 	auth.Connection().Close()
@@ -82,18 +117,98 @@ func (auth Authenticator) Authenticate(username, password string) (string, error
 		return "", err
 	}
 
-	// Bind as the user to verify their password
-	userdn := entry.DN
-	err = auth.Connection().Bind(userdn, password)
+	// Bind as the user to verify their password, on a connection of its own to keep the shared one bound as bindDN
+	conn, err := dial(auth.bindURL)
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
-	defer auth.bindReadUser()
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return "", err
+	}
 
 	return entry.GetAttributeValue("uid"), nil
 }
 
+// GetAllUsers returns all users below the query DN
+func (auth Authenticator) GetAllUsers() ([]interface{}, error) {
+	searchRequest := ldap.NewSearchRequest(
+		auth.queryDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=organizationalPerson)",
+		auth.selectors,
+		nil)
+
+	sr, err := auth.Connection().SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]interface{}, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		users = append(users, auth.transformer.Transform(entry))
+	}
+
+	return users, nil
+}
+
+// GetUsersChangedSince returns all users below the query DN whose changeAttribute is not older than mark, together with
+// the newest changeAttribute value seen. All users are returned if mark is empty.
+func (auth Authenticator) GetUsersChangedSince(changeAttribute, mark string) ([]interface{}, string, error) {
+	filter := "(objectClass=organizationalPerson)"
+	if mark != "" {
+		filter = fmt.Sprintf("(&%s(%s>=%s))", filter, changeAttribute, ldap.EscapeFilter(mark))
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		auth.queryDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		append([]string{changeAttribute}, auth.selectors...),
+		nil)
+
+	sr, err := auth.Connection().SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newestMark := mark
+	users := make([]interface{}, 0, len(sr.Entries))
+	for _, entry := range sr.Entries {
+		users = append(users, auth.transformer.Transform(entry))
+		newestMark = NewestChangeMark(newestMark, entry.GetAttributeValue(changeAttribute))
+	}
+
+	return users, newestMark, nil
+}
+
+// NewestChangeMark returns the newer of two values of a change attribute. Numbers like uSNChanged are compared
+// numerically, timestamps in generalized time lexically.
+func NewestChangeMark(a, b string) string {
+	numberA, errA := strconv.ParseInt(a, 10, 64)
+	numberB, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		if numberB > numberA {
+			return b
+		}
+		return a
+	}
+
+	if b > a {
+		return b
+	}
+	return a
+}
+
 // GetUserByID searches for the given user id and returns it if there is such a user.
 func (auth Authenticator) GetUserByID(id string) (interface{}, error) {
 	entry, err := auth.searchForUser(id)
@@ -104,22 +219,55 @@ func (auth Authenticator) GetUserByID(id string) (interface{}, error) {
 	return auth.transformer.Transform(entry), nil
 }
 
-func (auth *Authenticator) searchForUser(uid string) (*ldap.Entry, error) {
-	if auth.bindURL == "" {
-		log.Fatal(errors.New("ran a query without connecting to the server"))
+// GetUserEntry returns the entry of the user with the given uid holding only the given attributes
+func (auth *Authenticator) GetUserEntry(uid string, attributes []string) (*ldap.Entry, error) {
+	return auth.searchForUserAttributes(uid, attributes)
+}
+
+// GetUIDByDN returns the uid of the user entry with the given DN, which has to lie below the query DN
+func (auth *Authenticator) GetUIDByDN(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+	base, err := ldap.ParseDN(auth.queryDN)
+	if err != nil {
+		return "", err
+	}
+	if !base.Equal(parsed) && !base.AncestorOf(parsed) {
+		return "", ErrUserNotFound
 	}
 
-	// The username and password we want to check
-	bindusername := auth.bindDN
-	bindpassword := auth.bindPassword
+	searchRequest := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=organizationalPerson)",
+		[]string{"uid"},
+		nil)
 
-	// First bind with a read only user
-	err := auth.Connection().Bind(bindusername, bindpassword)
+	sr, err := auth.Connection().Search(searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || err == nil && len(sr.Entries) == 0 {
+		return "", ErrUserNotFound
+	}
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	defer auth.bindReadUser()
+	return sr.Entries[0].GetAttributeValue("uid"), nil
+}
+
+func (auth *Authenticator) searchForUser(uid string) (*ldap.Entry, error) {
+	return auth.searchForUserAttributes(uid, auth.selectors)
+}
+
+func (auth *Authenticator) searchForUserAttributes(uid string, attributes []string) (*ldap.Entry, error) {
+	if auth.bindURL == "" {
+		logging.Fatal(errors.New("ran a query without connecting to the server"))
+	}
 
 	// Search for the given username
 	searchRequest := ldap.NewSearchRequest(
@@ -129,8 +277,8 @@ func (auth *Authenticator) searchForUser(uid string) (*ldap.Entry, error) {
 		0,
 		0,
 		false,
-		fmt.Sprintf("(&(objectClass=organizationalPerson)(uid=%s))", uid),
-		auth.selectors,
+		fmt.Sprintf("(&(objectClass=organizationalPerson)(uid=%s))", ldap.EscapeFilter(uid)),
+		attributes,
 		nil)
 
 	sr, err := auth.Connection().Search(searchRequest)
@@ -138,16 +286,13 @@ func (auth *Authenticator) searchForUser(uid string) (*ldap.Entry, error) {
 		return nil, err
 	}
 
-	if len(sr.Entries) != 1 {
-		return nil, errors.New("user does not exist or there is technically more than one")
+	if len(sr.Entries) == 0 {
+		return nil, ErrUserNotFound
 	}
 
-	return sr.Entries[0], nil
-}
-
-func (auth *Authenticator) bindReadUser() {
-	bindusername := auth.bindDN
-	bindpassword := auth.bindPassword
+	if len(sr.Entries) > 1 {
+		return nil, errors.New("there is technically more than one user with this uid")
+	}
 
-	auth.Connection().Bind(bindusername, bindpassword)
+	return sr.Entries[0], nil
 }
@@ -0,0 +1,26 @@
+package ldapauthenticator
+
+import "testing"
+
+func TestNewestChangeMark(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected string
+	}{
+		{"", "", ""},
+		{"", "42", "42"},
+		{"42", "", "42"},
+		{"9", "10", "10"},
+		{"10", "9", "10"},
+		{"123456789012", "99", "123456789012"},
+		{"20200101120000Z", "20191231235959Z", "20200101120000Z"},
+		{"20191231235959Z", "20200101120000Z", "20200101120000Z"},
+		{"20200101120000Z", "20200101120000Z", "20200101120000Z"},
+	}
+
+	for _, test := range tests {
+		if actual := NewestChangeMark(test.a, test.b); actual != test.expected {
+			t.Errorf("NewestChangeMark(%q, %q) = %q, expected %q", test.a, test.b, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package ldapauthenticator
+
+import (
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "ldap",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of LDAP binds and searches.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"operation"})
+
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "ldap",
+		Name:      "requests_total",
+		Help:      "LDAP binds and searches by result: success, invalid_credentials or error.",
+	}, []string{"operation", "result"})
+)
+
+// Conn is a LDAP connection recording the latency and errors of binds and searches
+type Conn struct {
+	*ldap.Conn
+}
+
+// Bind binds with the given credentials
+func (conn *Conn) Bind(username, password string) error {
+	start := time.Now()
+	err := conn.Conn.Bind(username, password)
+	observe("bind", start, err)
+
+	return err
+}
+
+// Search runs the search request
+func (conn *Conn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	start := time.Now()
+	result, err := conn.Conn.Search(searchRequest)
+	observe("search", start, err)
+
+	return result, err
+}
+
+// SearchWithPaging runs the search request reading pages of the given size
+func (conn *Conn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	start := time.Now()
+	result, err := conn.Conn.SearchWithPaging(searchRequest, pagingSize)
+	observe("search", start, err)
+
+	return result, err
+}
+
+func observe(operation string, start time.Time, err error) {
+	requestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	result := "success"
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		result = "invalid_credentials"
+	} else if err != nil {
+		result = "error"
+	}
+	requests.WithLabelValues(operation, result).Inc()
+}
@@ -0,0 +1,474 @@
+package ldapauthenticator
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// OIDs of the LDAP Content Synchronization Operation, RFC 4533
+const (
+	controlTypeSyncRequest = "1.3.6.1.4.1.4203.1.9.1.1"
+	controlTypeSyncState   = "1.3.6.1.4.1.4203.1.9.1.2"
+	controlTypeSyncDone    = "1.3.6.1.4.1.4203.1.9.1.3"
+	responseNameSyncInfo   = "1.3.6.1.4.1.4203.1.9.1.4"
+
+	oidStartTLS = "1.3.6.1.4.1.1466.20037"
+	oidWhoAmI   = "1.3.6.1.4.1.4203.1.11.3"
+
+	applicationIntermediateResponse = 25
+
+	syncModeRefreshAndPersist = 3
+
+	// syncreplKeepAlive is the interval of the keepalive requests of a session. A session without any message
+	// for two intervals, not even the response to a keepalive, is considered broken.
+	syncreplKeepAlive = 2 * time.Minute
+)
+
+// SyncState is the state of an entry reported by a syncrepl session
+type SyncState int64
+
+// States of the Sync State Control
+const (
+	SyncStatePresent SyncState = iota
+	SyncStateAdd
+	SyncStateModify
+	SyncStateDelete
+)
+
+// ErrSyncreplUnsupported is returned if the server does not support the Content Synchronization Operation
+var ErrSyncreplUnsupported = errors.New("the server does not support syncrepl")
+
+// SyncHandler receives the notifications of a syncrepl session
+type SyncHandler interface {
+	// Entry is called for every added, modified or deleted entry. Deleted entries only carry their DN.
+	Entry(state SyncState, entry *Entry)
+	// Cookie is called whenever the server hands out a new sync cookie
+	Cookie(cookie []byte)
+	// RefreshDone is called at the end of the refresh phase, all further notifications are live changes
+	RefreshDone()
+}
+
+// Syncrepl opens a refreshAndPersist syncrepl session on baseDN and feeds all notifications into handler.
+// Starting from cookie, only changes since the session which handed it out are sent. The session runs
+// until the connection breaks, it returns ErrSyncreplUnsupported if the server rejects the sync request.
+func (auth *Authenticator) Syncrepl(baseDN, filter string, attributes []string, cookie []byte, handler SyncHandler) error {
+	conn, err := auth.dialRaw()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session := syncreplSession{conn: conn}
+
+	if err := session.simpleBind(auth.bindDN, auth.bindPassword); err != nil {
+		return err
+	}
+
+	if err := session.search(baseDN, filter, attributes, cookie); err != nil {
+		return err
+	}
+
+	return session.receive(handler)
+}
+
+// dialRaw opens a connection to the LDAP server like Connect, without go-ldap's message handling,
+// which cannot deal with a search that never ends
+func (auth *Authenticator) dialRaw() (net.Conn, error) {
+	lurl, err := url.Parse(auth.bindURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(lurl.Host)
+	if err != nil {
+		host = lurl.Host
+		port = ""
+	}
+
+	switch lurl.Scheme {
+	case "ldaps":
+		if port == "" {
+			port = ldap.DefaultLdapsPort
+		}
+		return tls.Dial("tcp", net.JoinHostPort(host, port), &tls.Config{InsecureSkipVerify: true})
+
+	case "ldap":
+		if port == "" {
+			port = ldap.DefaultLdapPort
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), ldap.DefaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		// Upgrade connection to TLS like Connect does
+		session := syncreplSession{conn: conn}
+		if err := session.startTLS(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return nil, fmt.Errorf("unknown scheme %s", lurl.Scheme)
+}
+
+type syncreplSession struct {
+	conn net.Conn
+
+	// mutex guards sending, keepalives are sent while the session receives
+	mutex     sync.Mutex
+	messageID int64
+}
+
+// send wraps op into an LDAPMessage and writes it to the connection
+func (session *syncreplSession) send(op *ber.Packet, controls ...*ber.Packet) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.messageID++
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, session.messageID, "MessageID"))
+	packet.AppendChild(op)
+
+	if len(controls) > 0 {
+		controlsPacket := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			controlsPacket.AppendChild(control)
+		}
+		packet.AppendChild(controlsPacket)
+	}
+
+	_, err := session.conn.Write(packet.Bytes())
+	return err
+}
+
+// read returns the protocol operation and the controls of the next message
+func (session *syncreplSession) read() (*ber.Packet, []*ber.Packet, error) {
+	packet, err := ber.ReadPacket(session.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(packet.Children) < 2 {
+		return nil, nil, errors.New("malformed LDAP message")
+	}
+
+	var controls []*ber.Packet
+	if len(packet.Children) > 2 {
+		controls = packet.Children[2].Children
+	}
+
+	return packet.Children[1], controls, nil
+}
+
+// readResult reads the next message and returns an error unless it is a successful result of the given type
+func (session *syncreplSession) readResult(application ber.Tag) error {
+	op, _, err := session.read()
+	if err != nil {
+		return err
+	}
+
+	if op.ClassType != ber.ClassApplication || op.Tag != application {
+		return fmt.Errorf("unexpected LDAP response %d", op.Tag)
+	}
+
+	return resultError(op)
+}
+
+func (session *syncreplSession) startTLS() error {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oidStartTLS, "TLS Extended Command"))
+	if err := session.send(request); err != nil {
+		return err
+	}
+
+	return session.readResult(ldap.ApplicationExtendedResponse)
+}
+
+func (session *syncreplSession) simpleBind(bindDN, bindPassword string) error {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, bindDN, "User Name"))
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, bindPassword, "Password"))
+	if err := session.send(request); err != nil {
+		return err
+	}
+
+	return session.readResult(ldap.ApplicationBindResponse)
+}
+
+func (session *syncreplSession) search(baseDN, filter string, attributes []string, cookie []byte) error {
+	compiledFilter, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, baseDN, "Base DN"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.ScopeWholeSubtree, "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.NeverDerefAliases, "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(compiledFilter)
+
+	attributesPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attribute := range attributes {
+		attributesPacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute"))
+	}
+	request.AppendChild(attributesPacket)
+
+	return session.send(request, syncRequestControl(cookie))
+}
+
+// syncRequestControl encodes the Sync Request Control asking for a refreshAndPersist session
+func syncRequestControl(cookie []byte) *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sync Request Value")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, syncModeRefreshAndPersist, "Mode"))
+	if len(cookie) > 0 {
+		value.AppendChild(octetString(cookie, "Cookie"))
+	}
+
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlTypeSyncRequest, "Control Type"))
+	control.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	control.AppendChild(octetString(value.Bytes(), "Control Value"))
+
+	return control
+}
+
+func octetString(value []byte, description string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, description)
+	packet.Value = value
+	packet.Data.Write(value)
+
+	return packet
+}
+
+// keepAlive sends a Who am I? request every syncreplKeepAlive until done is closed, so a half-open
+// connection is noticed by the read deadline of receive
+func (session *syncreplSession) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(syncreplKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Who Am I")
+			request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oidWhoAmI, "Who Am I Extended Command"))
+			if err := session.send(request); err != nil {
+				// the read fails as well and ends the session
+				return
+			}
+		}
+	}
+}
+
+// receive dispatches the search results to handler until the session ends
+func (session *syncreplSession) receive(handler SyncHandler) error {
+	done := make(chan struct{})
+	defer close(done)
+	go session.keepAlive(done)
+
+	for {
+		if err := session.conn.SetReadDeadline(time.Now().Add(2 * syncreplKeepAlive)); err != nil {
+			return err
+		}
+
+		op, controls, err := session.read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("the server closed the syncrepl session")
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return errors.New("the syncrepl session timed out, the connection is broken")
+		}
+		if err != nil {
+			return err
+		}
+
+		if op.ClassType != ber.ClassApplication {
+			continue
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationSearchResultEntry:
+			session.handleEntry(op, controls, handler)
+
+		case applicationIntermediateResponse:
+			session.handleSyncInfo(op, handler)
+
+		case ldap.ApplicationSearchResultDone:
+			if err := resultError(op); err != nil {
+				if ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension) || ldap.IsErrorWithCode(err, ldap.LDAPResultProtocolError) {
+					return ErrSyncreplUnsupported
+				}
+				return err
+			}
+
+			// a refreshAndPersist session only ends if the server stops it
+			if value := controlValue(controls, controlTypeSyncDone); value != nil {
+				if cookie := optionalCookie(value.Children); cookie != nil {
+					handler.Cookie(cookie)
+				}
+			}
+			return errors.New("the server ended the syncrepl session")
+		}
+	}
+}
+
+func (session *syncreplSession) handleEntry(op *ber.Packet, controls []*ber.Packet, handler SyncHandler) {
+	if len(op.Children) < 2 {
+		return
+	}
+
+	entry := &Entry{DN: string(op.Children[0].ByteValue)}
+	for _, attribute := range op.Children[1].Children {
+		if len(attribute.Children) < 2 {
+			continue
+		}
+
+		entryAttribute := &ldap.EntryAttribute{Name: string(attribute.Children[0].ByteValue)}
+		for _, value := range attribute.Children[1].Children {
+			entryAttribute.Values = append(entryAttribute.Values, string(value.ByteValue))
+			entryAttribute.ByteValues = append(entryAttribute.ByteValues, value.ByteValue)
+		}
+		entry.Attributes = append(entry.Attributes, entryAttribute)
+	}
+
+	// SEQUENCE { state ENUMERATED, entryUUID OCTET STRING, cookie OCTET STRING OPTIONAL }
+	value := controlValue(controls, controlTypeSyncState)
+	if value == nil || len(value.Children) < 2 {
+		return
+	}
+
+	state, _ := value.Children[0].Value.(int64)
+	if SyncState(state) != SyncStatePresent {
+		handler.Entry(SyncState(state), entry)
+	}
+
+	if len(value.Children) > 2 {
+		handler.Cookie(value.Children[2].ByteValue)
+	}
+}
+
+// handleSyncInfo processes the Sync Info Message, an intermediate response
+func (session *syncreplSession) handleSyncInfo(op *ber.Packet, handler SyncHandler) {
+	var name string
+	var rawValue []byte
+	for _, child := range op.Children {
+		switch child.Tag {
+		case 0:
+			name = child.Data.String()
+		case 1:
+			rawValue = child.Data.Bytes()
+		}
+	}
+
+	if name != responseNameSyncInfo || rawValue == nil {
+		return
+	}
+
+	value, err := ber.DecodePacketErr(rawValue)
+	if err != nil {
+		logging.Errorf("Could not decode sync info message, got error: %+v", err)
+		return
+	}
+
+	switch value.Tag {
+	// newcookie [0] syncCookie
+	case 0:
+		handler.Cookie(value.Data.Bytes())
+
+	// refreshDelete [1] and refreshPresent [2]: SEQUENCE { cookie OPTIONAL, refreshDone BOOLEAN DEFAULT TRUE }
+	case 1, 2:
+		if cookie := optionalCookie(value.Children); cookie != nil {
+			handler.Cookie(cookie)
+		}
+
+		refreshDone := true
+		for _, child := range value.Children {
+			if child.Tag == ber.TagBoolean {
+				refreshDone, _ = child.Value.(bool)
+			}
+		}
+		if refreshDone {
+			handler.RefreshDone()
+		}
+
+	// syncIdSet [3]: SEQUENCE { cookie OPTIONAL, refreshDeletes BOOLEAN DEFAULT FALSE, syncUUIDs SET OF syncUUID }
+	case 3:
+		if cookie := optionalCookie(value.Children); cookie != nil {
+			handler.Cookie(cookie)
+		}
+
+		// entries identified by their entryUUID only cannot be mapped to users, they are left to the full sync
+		for _, child := range value.Children {
+			if child.Tag == ber.TagSet {
+				logging.Infof("Syncrepl reported %d entries by UUID only, the next full sync handles them.", len(child.Children))
+			}
+		}
+	}
+}
+
+// optionalCookie returns the cookie among the children of a sync message, if any
+func optionalCookie(children []*ber.Packet) []byte {
+	for _, child := range children {
+		if child.ClassType == ber.ClassUniversal && child.Tag == ber.TagOctetString {
+			return child.ByteValue
+		}
+	}
+
+	return nil
+}
+
+// controlValue returns the decoded value of the control with the given type, nil if there is none
+func controlValue(controls []*ber.Packet, controlType string) *ber.Packet {
+	for _, control := range controls {
+		if len(control.Children) < 2 || string(control.Children[0].ByteValue) != controlType {
+			continue
+		}
+
+		// the value is the last child, criticality is optional
+		value, err := ber.DecodePacketErr(control.Children[len(control.Children)-1].ByteValue)
+		if err != nil {
+			return nil
+		}
+		return value
+	}
+
+	return nil
+}
+
+// resultError returns the error of an LDAPResult, nil if it succeeded
+func resultError(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+
+	code, _ := op.Children[0].Value.(int64)
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+
+	return ldap.NewError(uint16(code), errors.New(string(op.Children[2].ByteValue)))
+}
@@ -0,0 +1,254 @@
+package ldapauthenticator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// recordingHandler records the notifications of a session as strings
+type recordingHandler struct {
+	events []string
+}
+
+func (handler *recordingHandler) Entry(state SyncState, entry *Entry) {
+	event := fmt.Sprintf("entry %d %s", state, entry.DN)
+	for _, attribute := range entry.Attributes {
+		event += fmt.Sprintf(" %s=%v", attribute.Name, attribute.Values)
+	}
+	handler.events = append(handler.events, event)
+}
+
+func (handler *recordingHandler) Cookie(cookie []byte) {
+	handler.events = append(handler.events, "cookie "+string(cookie))
+}
+
+func (handler *recordingHandler) RefreshDone() {
+	handler.events = append(handler.events, "refresh done")
+}
+
+// wire encodes and decodes the packet like it is read from a connection
+func wire(t *testing.T, packet *ber.Packet) *ber.Packet {
+	decoded, err := ber.DecodePacketErr(packet.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func sequence(children ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, child := range children {
+		packet.AppendChild(child)
+	}
+	return packet
+}
+
+func context(tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, "")
+	for _, child := range children {
+		packet.AppendChild(child)
+	}
+	return packet
+}
+
+func contextString(tag ber.Tag, value []byte) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypePrimitive, tag, nil, "")
+	packet.Data.Write(value)
+	return packet
+}
+
+func str(value string) *ber.Packet {
+	return octetString([]byte(value), "")
+}
+
+func enumerated(value int64) *ber.Packet {
+	return ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, value, "")
+}
+
+func boolean(value bool) *ber.Packet {
+	return ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, value, "")
+}
+
+// control encodes a control, the criticality is left out if critical is nil
+func control(controlType string, critical *bool, value *ber.Packet) *ber.Packet {
+	packet := sequence(str(controlType))
+	if critical != nil {
+		packet.AppendChild(boolean(*critical))
+	}
+	packet.AppendChild(octetString(value.Bytes(), ""))
+	return packet
+}
+
+func TestSyncRequestControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie []byte
+	}{
+		{"without cookie", nil},
+		{"with cookie", []byte("rid=001,csn=20200101120000.000000Z#000000#000#000000")},
+	}
+
+	for _, test := range tests {
+		decoded := wire(t, syncRequestControl(test.cookie))
+		if len(decoded.Children) != 3 {
+			t.Fatalf("%s: control has %d children, expected 3", test.name, len(decoded.Children))
+		}
+		if controlType := string(decoded.Children[0].ByteValue); controlType != controlTypeSyncRequest {
+			t.Errorf("%s: control type %s, expected %s", test.name, controlType, controlTypeSyncRequest)
+		}
+		if critical, _ := decoded.Children[1].Value.(bool); !critical {
+			t.Errorf("%s: control is not critical", test.name)
+		}
+
+		value := controlValue([]*ber.Packet{decoded}, controlTypeSyncRequest)
+		if value == nil {
+			t.Fatalf("%s: control value could not be decoded", test.name)
+		}
+		if mode, _ := value.Children[0].Value.(int64); mode != syncModeRefreshAndPersist {
+			t.Errorf("%s: mode %d, expected %d", test.name, mode, syncModeRefreshAndPersist)
+		}
+		if cookie := optionalCookie(value.Children); !reflect.DeepEqual(cookie, test.cookie) {
+			t.Errorf("%s: cookie %q, expected %q", test.name, cookie, test.cookie)
+		}
+	}
+}
+
+func TestControlValue(t *testing.T) {
+	critical := true
+	stateValue := sequence(enumerated(int64(SyncStateModify)), str("uuid"))
+	malformed := sequence(str(controlTypeSyncState), octetString([]byte{0x30, 0x05, 0x01}, ""))
+
+	tests := []struct {
+		name     string
+		controls []*ber.Packet
+		found    bool
+	}{
+		{"no controls", nil, false},
+		{"without criticality", []*ber.Packet{control(controlTypeSyncState, nil, stateValue)}, true},
+		{"with criticality", []*ber.Packet{control(controlTypeSyncState, &critical, stateValue)}, true},
+		{"other control first", []*ber.Packet{control(controlTypeSyncDone, nil, sequence()), control(controlTypeSyncState, nil, stateValue)}, true},
+		{"other control only", []*ber.Packet{control(controlTypeSyncDone, nil, sequence())}, false},
+		{"malformed value", []*ber.Packet{malformed}, false},
+		{"too few children", []*ber.Packet{sequence(str(controlTypeSyncState))}, false},
+	}
+
+	for _, test := range tests {
+		var controls []*ber.Packet
+		for _, control := range test.controls {
+			controls = append(controls, wire(t, control))
+		}
+
+		value := controlValue(controls, controlTypeSyncState)
+		if (value != nil) != test.found {
+			t.Errorf("%s: found value %t, expected %t", test.name, value != nil, test.found)
+			continue
+		}
+		if value != nil && string(value.Children[1].ByteValue) != "uuid" {
+			t.Errorf("%s: decoded value %v", test.name, value.Children)
+		}
+	}
+}
+
+func TestOptionalCookie(t *testing.T) {
+	tests := []struct {
+		name     string
+		children []*ber.Packet
+		expected []byte
+	}{
+		{"none", nil, nil},
+		{"only flag", []*ber.Packet{boolean(false)}, nil},
+		{"cookie", []*ber.Packet{str("cookie"), boolean(true)}, []byte("cookie")},
+		{"context tagged string", []*ber.Packet{contextString(0, []byte("other"))}, nil},
+	}
+
+	for _, test := range tests {
+		decoded := wire(t, sequence(test.children...))
+		if cookie := optionalCookie(decoded.Children); !reflect.DeepEqual(cookie, test.expected) {
+			t.Errorf("%s: optionalCookie = %q, expected %q", test.name, cookie, test.expected)
+		}
+	}
+}
+
+func TestHandleEntry(t *testing.T) {
+	searchResultEntry := func() *ber.Packet {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		op.AppendChild(str("uid=jdoe,ou=people,dc=example,dc=org"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		values.AppendChild(str("John"))
+		values.AppendChild(str("Johnny"))
+		op.AppendChild(sequence(sequence(str("givenName"), values)))
+		return op
+	}
+	stateControl := func(state SyncState, cookie string) *ber.Packet {
+		value := sequence(enumerated(int64(state)), str("uuid"))
+		if cookie != "" {
+			value.AppendChild(str(cookie))
+		}
+		return control(controlTypeSyncState, nil, value)
+	}
+
+	tests := []struct {
+		name     string
+		controls []*ber.Packet
+		expected []string
+	}{
+		{"add", []*ber.Packet{stateControl(SyncStateAdd, "")}, []string{"entry 1 uid=jdoe,ou=people,dc=example,dc=org givenName=[John Johnny]"}},
+		{"modify with cookie", []*ber.Packet{stateControl(SyncStateModify, "c1")}, []string{"entry 2 uid=jdoe,ou=people,dc=example,dc=org givenName=[John Johnny]", "cookie c1"}},
+		{"delete", []*ber.Packet{stateControl(SyncStateDelete, "")}, []string{"entry 3 uid=jdoe,ou=people,dc=example,dc=org givenName=[John Johnny]"}},
+		{"present is skipped", []*ber.Packet{stateControl(SyncStatePresent, "c2")}, []string{"cookie c2"}},
+		{"without state control", nil, nil},
+	}
+
+	for _, test := range tests {
+		var controls []*ber.Packet
+		for _, control := range test.controls {
+			controls = append(controls, wire(t, control))
+		}
+
+		handler := &recordingHandler{}
+		(&syncreplSession{}).handleEntry(wire(t, searchResultEntry()), controls, handler)
+		if !reflect.DeepEqual(handler.events, test.expected) {
+			t.Errorf("%s: events %q, expected %q", test.name, handler.events, test.expected)
+		}
+	}
+}
+
+func TestHandleSyncInfo(t *testing.T) {
+	syncInfo := func(name string, value *ber.Packet) *ber.Packet {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationIntermediateResponse, nil, "")
+		op.AppendChild(contextString(0, []byte(name)))
+		if value != nil {
+			op.AppendChild(contextString(1, value.Bytes()))
+		}
+		return op
+	}
+	uuids := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+	uuids.AppendChild(str("uuid1"))
+
+	tests := []struct {
+		name     string
+		op       *ber.Packet
+		expected []string
+	}{
+		{"new cookie", syncInfo(responseNameSyncInfo, contextString(0, []byte("c1"))), []string{"cookie c1"}},
+		{"refresh delete done", syncInfo(responseNameSyncInfo, context(1, str("c2"))), []string{"cookie c2", "refresh done"}},
+		{"refresh present done", syncInfo(responseNameSyncInfo, context(2, str("c3"), boolean(true))), []string{"cookie c3", "refresh done"}},
+		{"refresh present pending", syncInfo(responseNameSyncInfo, context(2, boolean(false))), nil},
+		{"refresh without cookie", syncInfo(responseNameSyncInfo, context(2)), []string{"refresh done"}},
+		{"sync id set", syncInfo(responseNameSyncInfo, context(3, str("c4"), boolean(true), uuids)), []string{"cookie c4"}},
+		{"other response", syncInfo("1.2.3", contextString(0, []byte("c5"))), nil},
+		{"without value", syncInfo(responseNameSyncInfo, nil), nil},
+	}
+
+	for _, test := range tests {
+		handler := &recordingHandler{}
+		(&syncreplSession{}).handleSyncInfo(wire(t, test.op), handler)
+		if !reflect.DeepEqual(handler.events, test.expected) {
+			t.Errorf("%s: events %q, expected %q", test.name, handler.events, test.expected)
+		}
+	}
+}
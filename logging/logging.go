@@ -0,0 +1,297 @@
+// Package logging writes leveled, structured log lines as text, logfmt or JSON and redacts secrets
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Levels in ascending severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+// ParseLevel parses debug, info, warn or error, the empty string is info
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %s, expected debug, info, warn or error", name)
+}
+
+// Format is the layout of log lines
+type Format int
+
+// Formats of log lines
+const (
+	// FormatText prints the time, level and message followed by the fields as key=value
+	FormatText Format = iota
+	FormatLogfmt
+	FormatJSON
+)
+
+// ParseFormat parses text, logfmt or json, the empty string is text
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "text":
+		return FormatText, nil
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+
+	return FormatText, fmt.Errorf("unknown log format %s, expected text, logfmt or json", name)
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes log lines carrying its fields
+type Logger struct {
+	fields []field
+}
+
+var (
+	mutex  sync.Mutex
+	output io.Writer = os.Stderr
+	level            = LevelInfo
+	format           = FormatText
+)
+
+// Configure sets the minimum level, the format and the output of all log lines
+func Configure(minLevel Level, lineFormat Format, out io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	level = minLevel
+	format = lineFormat
+	output = out
+}
+
+// With returns a logger adding the given key value pairs to every line
+func With(keyValues ...interface{}) Logger {
+	return Logger{}.With(keyValues...)
+}
+
+// With returns a logger adding the given key value pairs to the fields of this logger
+func (logger Logger) With(keyValues ...interface{}) Logger {
+	fields := make([]field, len(logger.fields), len(logger.fields)+len(keyValues)/2)
+	copy(fields, logger.fields)
+
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fields = append(fields, field{key: fmt.Sprint(keyValues[i]), value: keyValues[i+1]})
+	}
+
+	return Logger{fields: fields}
+}
+
+// Debugf logs a debug message
+func (logger Logger) Debugf(message string, args ...interface{}) {
+	logger.log(LevelDebug, message, args...)
+}
+
+// Infof logs an info message
+func (logger Logger) Infof(message string, args ...interface{}) {
+	logger.log(LevelInfo, message, args...)
+}
+
+// Warnf logs a warning
+func (logger Logger) Warnf(message string, args ...interface{}) {
+	logger.log(LevelWarn, message, args...)
+}
+
+// Errorf logs an error
+func (logger Logger) Errorf(message string, args ...interface{}) {
+	logger.log(LevelError, message, args...)
+}
+
+// Fatalf logs an error and exits
+func (logger Logger) Fatalf(message string, args ...interface{}) {
+	logger.log(LevelError, message, args...)
+	os.Exit(1)
+}
+
+// Debugf logs a debug message without fields
+func Debugf(message string, args ...interface{}) {
+	Logger{}.log(LevelDebug, message, args...)
+}
+
+// Infof logs an info message without fields
+func Infof(message string, args ...interface{}) {
+	Logger{}.log(LevelInfo, message, args...)
+}
+
+// Warnf logs a warning without fields
+func Warnf(message string, args ...interface{}) {
+	Logger{}.log(LevelWarn, message, args...)
+}
+
+// Errorf logs an error without fields
+func Errorf(message string, args ...interface{}) {
+	Logger{}.log(LevelError, message, args...)
+}
+
+// Fatal logs the error and exits
+func Fatal(err interface{}) {
+	Logger{}.Fatalf("%v", err)
+}
+
+func (logger Logger) log(lineLevel Level, message string, args ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if lineLevel < level {
+		return
+	}
+
+	if len(args) > 0 {
+		message = fmt.Sprintf(message, args...)
+	}
+	message = Redact(strings.TrimRight(message, "\n"))
+
+	fields := make([]field, 0, len(logger.fields))
+	for _, f := range logger.fields {
+		fields = append(fields, field{key: f.key, value: Redact(fmt.Sprint(f.value))})
+	}
+
+	var line bytes.Buffer
+	now := time.Now()
+	switch format {
+	case FormatJSON:
+		entry := map[string]interface{}{"time": now.Format(time.RFC3339Nano), "level": lineLevel.String(), "msg": message}
+		for _, f := range fields {
+			entry[f.key] = f.value
+		}
+		encoded, _ := json.Marshal(entry)
+		line.Write(encoded)
+
+	case FormatLogfmt:
+		fmt.Fprintf(&line, "time=%s level=%s msg=%s", now.Format(time.RFC3339Nano), lineLevel, logfmtValue(message))
+		writeFields(&line, fields)
+
+	default:
+		fmt.Fprintf(&line, "%s %s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(lineLevel.String()), message)
+		writeFields(&line, fields)
+	}
+	line.WriteByte('\n')
+
+	output.Write(line.Bytes())
+}
+
+func writeFields(line *bytes.Buffer, fields []field) {
+	for _, f := range fields {
+		fmt.Fprintf(line, " %s=%s", f.key, logfmtValue(fmt.Sprint(f.value)))
+	}
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+var (
+	secretsMutex sync.RWMutex
+	secrets      []string
+
+	// secretPatterns match credentials in formatted values, e.g. in %+v dumps of configurations or requests
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)((?:password|passwd|secret|token)"?\s*[:=]\s*"?)[^\s",}&]+`),
+		regexp.MustCompile(`(?i)(bearer\s+)[^\s",}]+`),
+	}
+)
+
+// AddSecret makes sure the value never appears in a log line
+func AddSecret(secret string) {
+	// very short values would garble every line, they are not worth protecting anyway
+	if len(secret) < 4 {
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	secrets = append(secrets, secret)
+	// replace longer secrets first in case one contains another
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces registered secrets and values of password, secret and token fields
+func Redact(value string) string {
+	secretsMutex.RLock()
+	for _, secret := range secrets {
+		value = strings.Replace(value, secret, "[REDACTED]", -1)
+	}
+	secretsMutex.RUnlock()
+
+	for _, pattern := range secretPatterns {
+		value = pattern.ReplaceAllString(value, "${1}[REDACTED]")
+	}
+
+	return value
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of the context, or one without fields
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKey{}).(Logger); ok {
+		return logger
+	}
+
+	return Logger{}
+}
+
+// StdWriter is an output for the standard log package, lines written by libraries are logged as info,
+// those starting with "ERROR: " as errors
+type StdWriter struct{}
+
+func (StdWriter) Write(line []byte) (int, error) {
+	message := strings.TrimRight(string(line), "\n")
+	if strings.HasPrefix(message, "ERROR: ") {
+		Errorf("%s", strings.TrimPrefix(message, "ERROR: "))
+	} else {
+		Infof("%s", message)
+	}
+
+	return len(line), nil
+}
@@ -0,0 +1,43 @@
+package logging
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	secretsMutex.Lock()
+	previous := secrets
+	secrets = nil
+	secretsMutex.Unlock()
+	defer func() {
+		secretsMutex.Lock()
+		secrets = previous
+		secretsMutex.Unlock()
+	}()
+
+	AddSecret("abc")
+	AddSecret("s3cr3t")
+	AddSecret("s3cr3t-and-more")
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"bind failed for s3cr3t", "bind failed for [REDACTED]"},
+		{"s3cr3t s3cr3t", "[REDACTED] [REDACTED]"},
+		{"key s3cr3t-and-more", "key [REDACTED]"},
+		{"too short to register: abc", "too short to register: abc"},
+		{"password=hunter22 user=jdoe", "password=[REDACTED] user=jdoe"},
+		{`{"Password":"hunter22","User":"jdoe"}`, `{"Password":"[REDACTED]","User":"jdoe"}`},
+		{"{BindPassword:hunter22 QueryDn:dc=example}", "{BindPassword:[REDACTED] QueryDn:dc=example}"},
+		{"client_secret=xyz&code=123", "client_secret=[REDACTED]&code=123"},
+		{"access_token: abcdef", "access_token: [REDACTED]"},
+		{"Authorization: Bearer abcdef", "Authorization: Bearer [REDACTED]"},
+		{"tokens are fine", "tokens are fine"},
+	}
+
+	for _, test := range tests {
+		if actual := Redact(test.value); actual != test.expected {
+			t.Errorf("Redact(%q) = %q, expected %q", test.value, actual, test.expected)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"database/sql"
 	"log"
+	"os"
+	"strings"
 
-	"github.com/jasonlvhit/gocron"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
 	"github.com/studieren-ohne-grenzen/mattermost-ldap/oauthenticator"
 
 	"github.com/RangelReale/osin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -16,17 +19,19 @@ func main() {
 
 	if err != nil {
 		showDefaults()
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 
 	config := parseConfig(*cli.ConfigPath)
+	configureLogging(config)
+	logging.AddSecret(*cli.ClientSecret)
 
-	log.Println("Initializing SQL connection")
+	logging.Infof("Initializing SQL connection")
 	url := config.Mysql.User + ":" + config.Mysql.Password + "@tcp(" + config.Mysql.Host + ":" + config.Mysql.Port + ")/" + config.Mysql.OauthDB + "?parseTime=true"
 
 	db, err := sql.Open("mysql", url)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 
 	cfg := osin.NewServerConfig()
@@ -34,40 +39,152 @@ func main() {
 	cfg.AllowClientSecretInParams = true
 
 	var transformer Transformer
-	// If ever necessary - refactor them into config.Ldap, however they are quite standard keep them for now
-	transformer.CNAttrName = "cn"
-	transformer.MailAttrName = "mail"
 	transformer.UIDAttrName = "uid"
+	transformer.IDAttrName = config.Attributes.ID
 	transformer.UsernamePrefix = config.Mattermost.UsernamePrefix
+	transformer.AdditionalSelectors = config.Ldap.AttrSelectors
+	transformer.PictureAttrName = config.Attributes.Picture
+	transformer.ChangeAttrName = config.Sync.ChangeAttribute
+	transformer.Mapping, err = newUserMapping(config.Attributes)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	transformer.DisabledAttrName = config.Ldap.DisabledAttribute
+	transformer.DisabledValues = config.Ldap.DisabledValue
 
 	ldapAuthenticator := NewAuthenticatorWithSync(config.Ldap.BindDn, config.Ldap.BindPassword, config.Ldap.QueryDn, config.Ldap.GroupMemberQuery, config.Ldap.GroupBaseDN, transformer)
+	if err := ldapAuthenticator.ConfigureSync(config.Sync); err != nil {
+		logging.Fatal(err)
+	}
+	syncs := *cli.StartServer || *cli.Sync || *cli.SyncUser != "" || *cli.MigrateUsers
+	if syncs && config.Sync.StateStore != "mysql" {
+		if err := lockStateFile(config.Sync.StateFile); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	state, err := openStateStore(config.Sync, db, config.Mysql.OauthSchemaPrefix)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	ldapAuthenticator.SetStateStore(state)
+	ldapAuthenticator.SetDryRun(*cli.DryRun)
+	if err := ldapAuthenticator.checkIDAttribute(); err != nil {
+		logging.Fatal(err)
+	}
+	if err := ldapAuthenticator.ConfigureAuthService(config.Oauth.Service, config.Oauth.PreviousService); err != nil {
+		logging.Fatal(err)
+	}
+	ldapAuthenticator.ConfigureReport(config.Report)
+	if err := ldapAuthenticator.ConfigureTeams(config.Team); err != nil {
+		logging.Fatal(err)
+	}
+	if err := ldapAuthenticator.ConfigureGroups(config.Ldap); err != nil {
+		logging.Fatal(err)
+	}
+	ldapAuthenticator.ConfigureChannels(config.Channel)
+	if err := ldapAuthenticator.ConfigureUserGroups(config.UserGroup); err != nil {
+		logging.Fatal(err)
+	}
+	ldapAuthenticator.ConfigureRoles(config.Roles, config.TeamAdmins)
+	avatarURL := ""
+	if config.Oauth.RouteAvatar != "" {
+		avatarURL = strings.TrimSuffix(config.General.PublicURL, "/") + config.Oauth.RouteAvatar
+	}
+	if err := ldapAuthenticator.ConfigurePictures(config.Attributes.PictureSize, avatarURL, config.Oauth.AvatarSecret); err != nil {
+		logging.Fatal(err)
+	}
+
 	if err := ldapAuthenticator.Connect(config.Ldap.BindURL); err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
+	}
+
+	token, err := config.Mattermost.AccessToken()
+	if err != nil {
+		logging.Fatal(err)
 	}
+	logging.AddSecret(token)
 
-	if err := ldapAuthenticator.ConnectMattermost(config.Mattermost.URL, config.Mattermost.Username, config.Mattermost.Password); err != nil {
-		log.Fatal(err)
+	if token != "" {
+		err = ldapAuthenticator.ConnectMattermostWithToken(config.Mattermost.URL, token)
+	} else {
+		err = ldapAuthenticator.ConnectMattermost(config.Mattermost.URL, config.Mattermost.Username, config.Mattermost.Password)
+	}
+	if err != nil {
+		logging.Fatal(err)
 	}
 
 	oauthServer := oauthenticator.NewServer(db, config.Mysql.OauthSchemaPrefix, cfg, &ldapAuthenticator)
 	oauthServer.RouteInfo = config.Oauth.RouteInfo
+	oauthServer.RouteAvatar = config.Oauth.RouteAvatar
+	oauthServer.AvatarRateLimit = config.Oauth.AvatarRateLimit
+	oauthServer.AvatarRateBurst = config.Oauth.AvatarRateBurst
 	oauthServer.RouteLogin = config.Oauth.RouteLogin
 	oauthServer.RouteStatic = config.Oauth.RouteStatic
 	oauthServer.RouteToken = config.Oauth.RouteToken
 	oauthServer.StaticPath = config.Oauth.StaticPath
 	oauthServer.TemplatePath = config.Oauth.TemplatePath
+	oauthServer.RouteJwks = config.Oauth.RouteJwks
+	if config.Oauth.Service == authServiceOpenID {
+		key, err := oauthenticator.LoadOpenIDKey(config.Oauth.OpenIDKeyFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if err := oauthServer.EnableOpenID(config.General.PublicURL, key); err != nil {
+			logging.Fatal(err)
+		}
+	}
 
 	if *cli.StartServer {
-		gocron.Every(30).Minutes().Do(ldapAuthenticator.syncAllOAuthUsers)
-		// gocron.Every(1).Day().Do(ldapAuthenticator.ReconnectMattermost, 5)
-		gocron.Start()
+		if err := ldapAuthenticator.startSchedule(); err != nil {
+			logging.Fatal(err)
+		}
+
+		go ldapAuthenticator.runExclusive("full sync", ldapAuthenticator.syncAllOAuthUsers)
 
-		go ldapAuthenticator.syncAllOAuthUsers()
+		if config.Sync.TriggerRoute != "" && config.Sync.TriggerToken != "" {
+			oauthServer.HandleFunc(config.Sync.TriggerRoute, ldapAuthenticator.HandleSyncTrigger, "POST")
+		}
+
+		if config.General.MetricsRoute != "" && config.General.MetricsAddr != "" {
+			go serveMetrics(config.General.MetricsAddr, config.General.MetricsRoute)
+		} else if config.General.MetricsRoute != "" {
+			oauthServer.HandleFunc(config.General.MetricsRoute, promhttp.Handler().ServeHTTP, "GET")
+		}
+
+		if config.Sync.Listen {
+			ldapAuthenticator.listenForChanges()
+		}
 
 		oauthServer.ListenAndServe(config.General.ListenAddr)
 
 	}
 
+	if *cli.Sync {
+		if *cli.FullSync {
+			ldapAuthenticator.syncAllOAuthUsers()
+		} else {
+			ldapAuthenticator.syncChanges()
+		}
+
+		printPlan(ldapAuthenticator.Plan(), *cli.PlanFormat)
+	}
+
+	if *cli.SyncUser != "" {
+		err := ldapAuthenticator.syncMattermostForUser(*cli.SyncUser)
+		ldapAuthenticator.flushState()
+		if err != nil {
+			logging.Fatal(err)
+		}
+	}
+
+	if *cli.MigrateUsers {
+		if err := ldapAuthenticator.migrateEmailUsers(*cli.MigrateMatch, *cli.MigrateMap); err != nil {
+			logging.Fatal(err)
+		}
+
+		printPlan(ldapAuthenticator.Plan(), *cli.PlanFormat)
+	}
+
 	if *cli.AddClient {
 		oauthServer.CreateClient(*cli.ClientID, *cli.ClientSecret, *cli.RedirectURI)
 	}
@@ -76,3 +193,39 @@ func main() {
 		oauthServer.RemoveClient(*cli.ClientID)
 	}
 }
+
+// configureLogging applies the log section and keeps the configured credentials out of the log
+func configureLogging(config config) {
+	level, err := logging.ParseLevel(config.Log.Level)
+	if err != nil {
+		logging.Fatal(err)
+	}
+
+	format, err := logging.ParseFormat(config.Log.Format)
+	if err != nil {
+		logging.Fatal(err)
+	}
+
+	logging.Configure(level, format, os.Stderr)
+
+	// libraries log through the standard logger
+	log.SetFlags(0)
+	log.SetOutput(logging.StdWriter{})
+
+	for _, secret := range []string{config.Ldap.BindPassword, config.Mysql.Password, config.Mattermost.Password, config.Mattermost.Token, config.Sync.TriggerToken, config.Oauth.AvatarSecret} {
+		logging.AddSecret(secret)
+	}
+}
+
+func printPlan(plan *syncPlan, format string) {
+	var err error
+	if format == "json" {
+		err = plan.WriteJSON(os.Stdout)
+	} else {
+		err = plan.WriteTable(os.Stdout)
+	}
+
+	if err != nil {
+		logging.Fatal(err)
+	}
+}
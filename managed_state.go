@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// keyIDAttribute holds the id attribute the AuthData of all users has been derived from
+const keyIDAttribute = "id-attribute"
+
+// checkIDAttribute refuses to run with another id attribute than before, since this would re-key the AuthData of all users
+func (auth *AuthenticatorWithSync) checkIDAttribute() error {
+	current := strings.ToLower(auth.transformer.idAttrName())
+
+	stored, err := auth.state.Get(bucketSync, keyIDAttribute)
+	if err != nil {
+		return err
+	}
+
+	if stored == "" {
+		if auth.dryRun {
+			return nil
+		}
+		return auth.state.Set(bucketSync, keyIDAttribute, current)
+	}
+
+	if stored != current {
+		return fmt.Errorf("the id attribute changed from %s to %s, which would detach all existing accounts, restore id = \"%s\" in [attributes]", stored, current, stored)
+	}
+
+	return nil
+}
+
+func membershipKey(containerID, userID string) string {
+	return containerID + "/" + userID
+}
+
+// markManaged remembers a team or channel membership as created or adopted by the sync
+func (auth *AuthenticatorWithSync) markManaged(bucket, containerID, userID string) {
+	if auth.dryRun {
+		return
+	}
+
+	key := membershipKey(containerID, userID)
+	if managed, err := auth.state.Get(bucket, key); err == nil && managed != "" {
+		return
+	}
+
+	if err := auth.state.Set(bucket, key, "1"); err != nil {
+		logging.Errorf("Could not store managed membership %s, got error: %+v", key, err)
+	}
+}
+
+// isManaged returns whether the membership has been created or adopted by the sync, only these are ever removed
+func (auth *AuthenticatorWithSync) isManaged(bucket, containerID, userID string) bool {
+	managed, err := auth.state.Get(bucket, membershipKey(containerID, userID))
+	if err != nil {
+		logging.Errorf("Could not read managed membership %s, got error: %+v", membershipKey(containerID, userID), err)
+		return false
+	}
+
+	return managed != ""
+}
+
+func (auth *AuthenticatorWithSync) forgetManaged(bucket, containerID, userID string) {
+	if err := auth.state.Delete(bucket, membershipKey(containerID, userID)); err != nil {
+		logging.Errorf("Could not delete managed membership %s, got error: %+v", membershipKey(containerID, userID), err)
+	}
+}
+
+// missingSince returns when the user was first found missing in LDAP, remembering now if they were not missing before
+func (auth *AuthenticatorWithSync) missingSince(userID string, now time.Time) time.Time {
+	stored, err := auth.state.Get(bucketMissingSince, userID)
+	if err != nil {
+		logging.Errorf("Could not read since when user %s is missing, got error: %+v", userID, err)
+		return now
+	}
+
+	if since, err := time.Parse(time.RFC3339, stored); err == nil {
+		return since
+	}
+
+	if !auth.dryRun {
+		if err := auth.state.Set(bucketMissingSince, userID, now.Format(time.RFC3339)); err != nil {
+			logging.Errorf("Could not store since when user %s is missing, got error: %+v", userID, err)
+		}
+	}
+
+	return now
+}
+
+// forgetMissing forgets the given users which are present in LDAP again or have been deactivated
+func (auth *AuthenticatorWithSync) forgetMissing(userIDs []string) {
+	if auth.dryRun {
+		return
+	}
+
+	missing, err := auth.state.Keys(bucketMissingSince)
+	if err != nil {
+		logging.Errorf("Could not read the missing users, got error: %+v", err)
+		return
+	}
+
+	forget := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		forget[id] = true
+	}
+
+	for _, id := range missing {
+		if !forget[id] {
+			continue
+		}
+
+		if err := auth.state.Delete(bucketMissingSince, id); err != nil {
+			logging.Errorf("Could not forget that user %s is missing, got error: %+v", id, err)
+		}
+	}
+}
+
+// userHash fingerprints everything the sync of a user depends on: the LDAP entry and groups,
+// the Mattermost user and the sync settings
+func (auth *AuthenticatorWithSync) userHash(data userData, groups []group, user *model.User) string {
+	ldapData, _ := json.Marshal(data)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s|%s|%v|", ldapData, data.Modified, groups)
+	fmt.Fprintf(hash, "%d|%d|%s|%s|", user.UpdateAt, user.DeleteAt, user.Roles, user.AuthService)
+	fmt.Fprintf(hash, "%v|%v|%v|%v|%v|%v|%v|%s", auth.channelMappings, auth.userGroupMappings, auth.rolesConfig, auth.teamAdminGroups, auth.teamAdminDirect, auth.teamPolicy, auth.teamTemplate, auth.authService)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// isUnchanged returns whether the user did not change since their last sync without changes
+func (auth *AuthenticatorWithSync) isUnchanged(user *model.User, hash string) bool {
+	stored, err := auth.state.Get(bucketUserHash, user.Id)
+	return err == nil && stored == hash
+}
+
+// storeUserHash stores the hash if the sync did not change anything, otherwise the next run has to verify the changes
+func (auth *AuthenticatorWithSync) storeUserHash(user *model.User, hash string, changed bool) {
+	if auth.dryRun {
+		return
+	}
+
+	var err error
+	if changed {
+		err = auth.state.Delete(bucketUserHash, user.Id)
+	} else {
+		err = auth.state.Set(bucketUserHash, user.Id, hash)
+	}
+
+	if err != nil {
+		logging.Errorf("Could not store the hash of user %s, got error: %+v", user.Username, err)
+	}
+}
+
+// recordUserResult remembers the users failing to sync until they succeed, incremental syncs retry them.
+// Disabled users are forgotten, they are not synced anymore.
+func (auth *AuthenticatorWithSync) recordUserResult(uid string, err error) {
+	if auth.dryRun {
+		return
+	}
+
+	if err == nil || err == errUserDisabled {
+		err = auth.state.Delete(bucketFailedUsers, uid)
+	} else {
+		err = auth.state.Set(bucketFailedUsers, uid, err.Error())
+	}
+
+	if err != nil {
+		logging.Errorf("Could not store the sync result of user %s, got error: %+v", uid, err)
+	}
+}
+
+// flushState persists the buffered changes of the state store, if it buffers them
+func (auth *AuthenticatorWithSync) flushState() {
+	flusher, ok := auth.state.(stateFlusher)
+	if !ok {
+		return
+	}
+
+	if err := flusher.Flush(); err != nil {
+		logging.Errorf("Could not write the sync state, got error: %+v", err)
+	}
+}
+
+// recordRun adds the finished run to the history if the state store keeps one
+func (auth *AuthenticatorWithSync) recordRun(stats *syncStats) {
+	recorder, ok := auth.state.(runRecorder)
+	if !ok || auth.dryRun {
+		return
+	}
+
+	if err := recorder.RecordRun(stats.run()); err != nil {
+		logging.Errorf("Could not record the sync run, got error: %+v", err)
+	}
+}
@@ -2,13 +2,41 @@ package main
 
 import (
 	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
 
-	"log"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// userIndex maps the AuthData of Mattermost users to their ids
+type userIndex struct {
+	mutex sync.RWMutex
+	ids   map[string]string
+}
+
+func (index *userIndex) replace(ids map[string]string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.ids = ids
+}
+
+func (index *userIndex) lookup(authData string) (string, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	id, found := index.ids[authData]
+	return id, found
+}
+
 func (auth *AuthenticatorWithSync) getAllOAuthUsers() ([]*model.User, error) {
+	return auth.getAllUsers(auth.isOAuthUser)
+}
+
+// getAllUsers returns all Mattermost users accepted by filter
+func (auth *AuthenticatorWithSync) getAllUsers(filter func(*model.User) bool) ([]*model.User, error) {
 	curPage := 0
 	terminate := false
 	var result []*model.User
@@ -21,7 +49,7 @@ func (auth *AuthenticatorWithSync) getAllOAuthUsers() ([]*model.User, error) {
 		}
 
 		for _, user := range users {
-			if user.AuthService == model.USER_AUTH_SERVICE_GITLAB {
+			if filter(user) {
 				result = append(result, user)
 			}
 		}
@@ -33,116 +61,439 @@ func (auth *AuthenticatorWithSync) getAllOAuthUsers() ([]*model.User, error) {
 	return result, nil
 }
 
-func (auth *AuthenticatorWithSync) syncOAuthUsersWithBackend([]*model.User) error {
-	users, err := auth.getAllOAuthUsers()
+func (auth *AuthenticatorWithSync) syncOAuthUsersWithBackend(users []*model.User) error {
+	started := time.Now()
+
+	// read before the users, so the next incremental sync does not miss any change made during this run
+	var groupMembers map[string][]string
+	var groupMark string
+	if auth.tracksChanges() {
+		var err error
+		if groupMembers, groupMark, err = auth.fetchGroupMembers(""); err != nil {
+			return err
+		}
+	}
 
+	// archived teams have to be restored before their members are synced
+	auth.syncTeamLifecycle()
+
+	// never deactivate anybody if the LDAP users could not be fetched
+	ldapUsers, userMark, err := auth.authenticator.GetUsersChangedSince(auth.changeAttribute(), "")
 	if err != nil {
 		return err
 	}
 
+	ldapUsersByAuthData := make(map[string]userData, len(ldapUsers))
+	for _, ldapUser := range ldapUsers {
+		ldapUsersByAuthData[ldapUser.(userData).authData()] = ldapUser.(userData)
+	}
+
+	index := make(map[string]string, len(users))
+	var oauthUsers []*model.User
 	for _, user := range users {
-		// strip off username prefix to obtain the actual username to feed into backend
-		username := strings.Replace(user.Username, auth.transformer.UsernamePrefix, "", 1)
-		log.Printf("Syncing user %s with backend.\n", username)
+		if user.AuthData != nil {
+			index[*user.AuthData] = user.Id
+			oauthUsers = append(oauthUsers, user)
+		}
+	}
+	auth.mattermostIndex.replace(index)
+
+	auth.startUserGroupRun()
+
+	var mutex sync.Mutex
+	var missingUsers []*model.User
+	var presentUsers []string
+
+	auth.parallel(len(oauthUsers), func(i int) {
+		user := oauthUsers[i]
+		missing := auth.syncUserWithBackend(user, ldapUsersByAuthData)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if missing {
+			missingUsers = append(missingUsers, user)
+		} else {
+			presentUsers = append(presentUsers, user.Id)
+		}
+	})
+
+	auth.forgetMissing(presentUsers)
+
+	auth.finishUserGroupRun()
+
+	auth.deactivateMissingUsers(missingUsers)
 
-		auth.syncMattermostForUser(username)
+	if auth.tracksChanges() {
+		auth.saveIncrementalState(groupMembers, ldapauthenticator.NewestChangeMark(userMark, groupMark), started)
 	}
+
 	return nil
 }
 
+// syncUserWithBackend syncs a single Mattermost user and returns whether the user is missing or disabled in LDAP
+func (auth *AuthenticatorWithSync) syncUserWithBackend(user *model.User, ldapUsersByAuthData map[string]userData) bool {
+	logger := logging.With("user", user.Username)
+
+	data, found := ldapUsersByAuthData[*user.AuthData]
+	if !found {
+		logger.Infof("User %s is missing in LDAP.", user.Username)
+		return true
+	}
+
+	logger.Infof("Syncing user %s with backend.", data.UID)
+	err := auth.syncUser(data, user)
+	if err == errUserDisabled {
+		return true
+	}
+
+	auth.currentStats().userSynced(err)
+	return false
+}
+
+// parallel calls fn for every index below count using the configured number of workers.
+// Every index is handled by a single worker, keeping the operations per user in order.
+func (auth *AuthenticatorWithSync) parallel(count int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < auth.workers(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// workers returns the number of users synced concurrently
+func (auth *AuthenticatorWithSync) workers() int {
+	if auth.syncConfig.Workers < 1 {
+		return 1
+	}
+
+	return auth.syncConfig.Workers
+}
+
 func (auth *AuthenticatorWithSync) syncAllOAuthUsers() {
+	auth.startStats("full")
+	defer auth.finishStats()
+	auth.resetGroupGraph()
+
+	if err := auth.checkMattermostConnection(); err != nil {
+		logging.Errorf("Error while syncing all OAuth users: %+v", err)
+		auth.currentStats().failed(err)
+		return
+	}
+
 	users, err := auth.getAllOAuthUsers()
 	if err != nil {
-		log.Printf("Error while syncing all OAuth users: %+v", err)
+		logging.Errorf("Error while syncing all OAuth users: %+v", err)
+		auth.currentStats().failed(err)
+		return
 	}
 
-	auth.syncOAuthUsersWithBackend(users)
+	if err := auth.syncOAuthUsersWithBackend(users); err != nil {
+		logging.Errorf("Error while syncing all OAuth users: %+v", err)
+		auth.currentStats().failed(err)
+	}
 }
 
-func (auth *AuthenticatorWithSync) checkMattermostUser(id int64, username, name, mail string) {
-	user, resp := auth.Mattermost().GetUserByEmail(mail, "")
-	if resp.Error != nil && resp.StatusCode != 404 {
-		log.Printf("ERROR: %+v", resp.Error)
+// findMattermostUser looks up the Mattermost user having the AuthData of the LDAP user.
+// It returns nil if there is no such user yet.
+func (auth *AuthenticatorWithSync) findMattermostUser(data userData) (*model.User, error) {
+	authData := data.authData()
+	matches := func(user *model.User) bool {
+		return auth.isOAuthUser(user) && user.AuthData != nil && *user.AuthData == authData
+	}
+
+	if id, found := auth.mattermostIndex.lookup(authData); found {
+		user, resp := auth.Mattermost().GetUser(id, "")
+		if resp.Error != nil && resp.StatusCode != 404 {
+			return nil, resp.Error
+		}
+
+		if resp.Error == nil && matches(user) {
+			return user, nil
+		}
+	}
+
+	// the user may not have been seen by a full sync yet, username and email are still likely to match
+	if user, resp := auth.Mattermost().GetUserByUsername(data.Username, ""); resp.Error == nil && matches(user) {
+		return user, nil
+	}
+
+	if user, resp := auth.Mattermost().GetUserByEmail(data.Email, ""); resp.Error == nil && matches(user) {
+		return user, nil
+	}
+
+	return nil, nil
+}
+
+// conflictingUser returns the Mattermost user other than user holding the given email or username
+func (auth *AuthenticatorWithSync) conflictingUser(user *model.User, email, username string) *model.User {
+	if user == nil || email != user.Email {
+		if other, resp := auth.Mattermost().GetUserByEmail(email, ""); resp.Error == nil && (user == nil || other.Id != user.Id) {
+			return other
+		}
+	}
+
+	if user == nil || username != user.Username {
+		if other, resp := auth.Mattermost().GetUserByUsername(username, ""); resp.Error == nil && (user == nil || other.Id != user.Id) {
+			return other
+		}
+	}
+
+	return nil
+}
+
+// deactivateMissingUsers deactivates all given users which are missing for longer than the grace period.
+// Nothing is deactivated if this would affect more than MaxDeactivations users at once.
+func (auth *AuthenticatorWithSync) deactivateMissingUsers(users []*model.User) {
+	if !auth.syncConfig.DeactivateUsers {
 		return
 	}
 
-	created := false
-	userID := strconv.FormatInt(id, 10)
-	if resp.StatusCode == 404 {
-		log.Println("Creating new user.")
+	now := time.Now()
+	var dueUsers []*model.User
+	for _, user := range users {
+		if user.DeleteAt != 0 {
+			// already deactivated
+			continue
+		}
+
+		since := auth.missingSince(user.Id, now)
+
+		if now.Sub(since) < auth.gracePeriod {
+			logging.Infof("User %s is missing in LDAP since %s, waiting for grace period.", user.Username, since.Format(time.RFC3339))
+			auth.Plan().record(actionDeactivationPending, user.Username, "", "until "+since.Add(auth.gracePeriod).Format(time.RFC3339))
+			continue
+		}
+
+		dueUsers = append(dueUsers, user)
+	}
+
+	if auth.syncConfig.MaxDeactivations > 0 && len(dueUsers) > auth.syncConfig.MaxDeactivations {
+		logging.Errorf("Refusing to deactivate %d users at once, the threshold is %d. Check the LDAP configuration.", len(dueUsers), auth.syncConfig.MaxDeactivations)
+		return
+	}
+
+	detail := ""
+	if auth.syncConfig.RevokeSessions {
+		detail = "revoke sessions"
+	}
+
+	for _, user := range dueUsers {
+		if !auth.planChange(actionDeactivateUser, user.Username, "", detail) {
+			continue
+		}
+
+		if _, resp := auth.Mattermost().UpdateUserActive(user.Id, false); resp.Error != nil {
+			logging.Errorf("Could not deactivate user %s, got error: %+v", user.Username, resp.Error)
+			auth.changeFailed(actionDeactivateUser, user.Username, "")
+			continue
+		}
+
+		logging.Infof("Deactivated user %s.", user.Username)
+		auth.forgetMissing([]string{user.Id})
+
+		if auth.syncConfig.RevokeSessions {
+			if _, resp := auth.Mattermost().RevokeAllSessions(user.Id); resp.Error != nil {
+				logging.Errorf("Could not revoke sessions of user %s, got error: %+v", user.Username, resp.Error)
+			}
+		}
+	}
+}
+
+// reactivateMattermostUser reactivates a previously deactivated user who returned to LDAP
+func (auth *AuthenticatorWithSync) reactivateMattermostUser(user *model.User) error {
+	if !auth.syncConfig.DeactivateUsers {
+		return nil
+	}
+
+	if !auth.planChange(actionReactivateUser, user.Username, "", "") {
+		return nil
+	}
+
+	if _, resp := auth.Mattermost().UpdateUserActive(user.Id, true); resp.Error != nil {
+		logging.Errorf("Could not reactivate user %s, got error: %+v", user.Username, resp.Error)
+		auth.changeFailed(actionReactivateUser, user.Username, "")
+		return resp.Error
+	}
+
+	user.DeleteAt = 0
+	logging.Infof("Reactivated user %s.", user.Username)
+
+	return nil
+}
+
+// checkMattermostUser creates the Mattermost user if user is nil, otherwise it patches all changed fields.
+// It returns the current Mattermost user or nil if it has not been created, and the error of a failed API call.
+func (auth *AuthenticatorWithSync) checkMattermostUser(data userData, user *model.User) (*model.User, error) {
+	userID := data.authData()
+	if user == nil {
+		if other := auth.conflictingUser(nil, data.Email, data.Username); other != nil {
+			logging.Errorf("Could not create user %s, email or username are already taken by %s.", data.Username, other.Username)
+			auth.planChange(actionConflict, data.Username, other.Username, "email or username already taken")
+			return nil, nil
+		}
+
+		if !auth.planChange(actionCreateUser, data.Username, data.Email, "") {
+			return nil, nil
+		}
+
+		logging.Infof("Creating new user.")
 		// auth user does not exist
 		var newUser model.User
-		newUser.AuthService = model.USER_AUTH_SERVICE_GITLAB
+		newUser.AuthService = auth.authService
 		newUser.AuthData = &userID
-		newUser.Email = mail
-		newUser.FirstName = name
-		newUser.Username = username
+		newUser.Email = data.Email
+		newUser.FirstName = data.FirstName
+		newUser.LastName = data.LastName
+		newUser.Nickname = data.Nickname
+		newUser.Position = data.Position
+		newUser.Locale = data.Locale
+		newUser.Username = data.Username
 		newUser.EmailVerified = true
 
-		user, resp = auth.Mattermost().CreateUser(&newUser)
+		user, resp := auth.Mattermost().CreateUser(&newUser)
 		if resp.Error != nil {
-			log.Printf("Could not create user with email %s, got error: %+v.", mail, resp.Error)
-			return
+			logging.Errorf("Could not create user with email %s, got error: %+v.", data.Email, resp.Error)
+			auth.changeFailed(actionCreateUser, data.Username, data.Email)
+			return nil, resp.Error
 		}
 
-		created = true
+		return user, nil
 	}
 
-	// Update user if not just created
-	if !created {
-		var patch model.UserPatch
-		patch.Username = &username
-		patch.Email = &mail
-		patch.FirstName = &strings.Split(name, " ")[0]
-		if len(strings.Split(name, " ")) > 1 {
-			patch.LastName = &strings.Split(name, " ")[1]
-		}
+	// Update user
+	patch := auth.userPatch(data)
+	if other := auth.conflictingUser(user, data.Email, data.Username); other != nil {
+		// keep email and username, but still update all other fields
+		logging.Errorf("Could not rename user %s, email or username are already taken by %s.", user.Username, other.Username)
+		auth.planChange(actionConflict, user.Username, other.Username, "email or username already taken")
+		patch.Email = &user.Email
+		patch.Username = &user.Username
+	}
 
-		_, resp = auth.Mattermost().PatchUser(user.Id, &patch)
-		if resp.Error != nil {
-			log.Printf("Could not update existing user, got Error %+v", resp.Error)
-			return
+	changes := userPatchChanges(user, patch)
+	if len(changes) == 0 {
+		return user, nil
+	}
+
+	if !auth.planChange(actionPatchUser, user.Username, "", strings.Join(changes, ", ")) {
+		return user, nil
+	}
+
+	patched, resp := auth.Mattermost().PatchUser(user.Id, patch)
+	if resp.Error != nil {
+		logging.Errorf("Could not update existing user, got Error %+v", resp.Error)
+		auth.changeFailed(actionPatchUser, user.Username, "")
+		return user, resp.Error
+	}
+
+	return patched, nil
+}
+
+// userPatch creates a patch of all mapped fields, unmapped optional fields are left untouched
+func (auth *AuthenticatorWithSync) userPatch(data userData) *model.UserPatch {
+	var patch model.UserPatch
+	patch.Username = &data.Username
+	patch.Email = &data.Email
+	patch.FirstName = &data.FirstName
+	patch.LastName = &data.LastName
+
+	mapping := auth.transformer.Mapping
+	if mapping.Nickname.isSet() {
+		patch.Nickname = &data.Nickname
+	}
+	if mapping.Position.isSet() {
+		patch.Position = &data.Position
+	}
+	if mapping.Locale.isSet() && data.Locale != "" {
+		patch.Locale = &data.Locale
+	}
+
+	return &patch
+}
+
+// userPatchChanges lists the fields the patch would change on user
+func userPatchChanges(user *model.User, patch *model.UserPatch) []string {
+	var changes []string
+	check := func(field, current string, patched *string) {
+		if patched != nil && *patched != current {
+			changes = append(changes, field+": "+current+" -> "+*patched)
 		}
 	}
 
+	check("username", user.Username, patch.Username)
+	check("email", user.Email, patch.Email)
+	check("first_name", user.FirstName, patch.FirstName)
+	check("last_name", user.LastName, patch.LastName)
+	check("nickname", user.Nickname, patch.Nickname)
+	check("position", user.Position, patch.Position)
+	check("locale", user.Locale, patch.Locale)
+
+	return changes
 }
 
-func (auth *AuthenticatorWithSync) checkGroupForMattermostUser(group group, mail string) {
-	group.uid = strings.Replace(group.uid, "_", "-", -1)
-	team, resp := auth.Mattermost().GetTeamByName(group.uid, "")
+func (auth *AuthenticatorWithSync) checkGroupForMattermostUser(group group, user *model.User) error {
+	name := auth.teamNameForGroup(group.uid)
+	logger := logging.With("user", user.Username, "team", name)
+	team, resp := auth.Mattermost().GetTeamByName(name, "")
 	if resp.Error != nil && resp.StatusCode != 404 {
-		log.Printf("ERROR: Could not find team %+v, got error: %+v.", group, resp.Error)
+		logger.Errorf("Could not find team %+v, got error: %+v.", group, resp.Error)
+		return resp.Error
 	}
 
 	if resp.StatusCode == 404 {
-		newTeam := model.Team{}
-		newTeam.Name = auth.normalizeGroupName(group.uid)
-		newTeam.DisplayName = group.name
-		newTeam.Type = "I"
-		team, resp = auth.Mattermost().CreateTeam(&newTeam)
+		auth.creationMutex.Lock()
+		defer auth.creationMutex.Unlock()
+
+		// another worker may have created the team meanwhile
+		team, resp = auth.Mattermost().GetTeamByName(name, "")
+		if resp.Error != nil && resp.StatusCode != 404 {
+			logger.Errorf("Could not find team %+v, got error: %+v.", group, resp.Error)
+			return resp.Error
+		}
+	}
+
+	if resp.StatusCode == 404 {
+		if !auth.planChange(actionCreateTeam, "", name, group.name) {
+			auth.planChange(actionAddTeamMember, user.Username, name, "")
+			return nil
+		}
+
+		team, resp = auth.Mattermost().CreateTeam(auth.newTeam(group, name))
 		if resp.Error != nil {
-			log.Printf("ERROR: Could not create Team %+v, got error %+v", group, resp.Error)
-			return
+			logger.Errorf("Could not create Team %+v, got error %+v", group, resp.Error)
+			auth.changeFailed(actionCreateTeam, "", name)
+			return resp.Error
 		}
 
-		log.Printf("Created new Team %s.\n", team.DisplayName)
+		logger.Infof("Created new Team %s.", team.DisplayName)
+		auth.bindTeam(group.uid, team)
 	}
 
-	user, userResp := auth.Mattermost().GetUserByEmail(mail, "")
-	if userResp.Error != nil {
-		log.Printf("ERROR: Could not fetch user when adding to team %+v, got error: %+v", group, userResp.Error)
-		return
+	if !auth.planChange(actionAddTeamMember, user.Username, team.Name, "") {
+		return nil
 	}
 
 	_, err := auth.Mattermost().AddTeamMember(team.Id, user.Id)
 	if err.Error != nil {
-		log.Printf("ERROR: Could add user to team %+v, got error: %+v", group, err.Error)
-		return
+		logger.Errorf("Could add user to team %+v, got error: %+v", group, err.Error)
+		auth.changeFailed(actionAddTeamMember, user.Username, team.Name)
+		return err.Error
 	}
+	auth.markManaged(bucketManagedTeamMember, team.Id, user.Id)
 
-	log.Printf("Added user %s to team %s \n", user.Email, team.DisplayName)
-}
+	logger.Infof("Added user %s to team %s", user.Email, team.DisplayName)
 
-func (auth *AuthenticatorWithSync) normalizeGroupName(name string) string {
-	return strings.Replace(name, "_", "-", -1)
+	return auth.joinDefaultChannels(team, user)
 }
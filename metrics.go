@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+var (
+	mattermostRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "mattermost",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of Mattermost API calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	mattermostRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "mattermost",
+		Name:      "requests_total",
+		Help:      "Mattermost API calls by endpoint and status code, 0 if the server could not be reached.",
+	}, []string{"method", "endpoint", "status"})
+
+	syncRunDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "run_duration_seconds",
+		Help:      "Duration of sync runs.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"kind"})
+
+	syncRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "runs_total",
+		Help:      "Sync runs by result: success, errors if some users failed or failed if the run was aborted.",
+	}, []string{"kind", "result"})
+
+	syncLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time the last sync run without errors finished.",
+	}, []string{"kind"})
+
+	syncUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "last_run_users",
+		Help:      "Users of the last sync run by result: synced, skipped as unchanged or error.",
+	}, []string{"kind", "result"})
+
+	syncChanges = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "last_run_changes",
+		Help:      "Changes applied by the last sync run by action, e.g. create-user or add-team-member.",
+	}, []string{"kind", "action"})
+
+	syncChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "sync",
+		Name:      "changes_total",
+		Help:      "Changes applied by all sync runs by action.",
+	}, []string{"action"})
+)
+
+// observeRun exports the statistics and the applied changes of a finished run, dry runs are left out
+func (auth *AuthenticatorWithSync) observeRun(stats *syncStats, plan *syncPlan) {
+	if auth.dryRun {
+		return
+	}
+
+	run := stats.run()
+	syncRunDuration.WithLabelValues(run.Kind).Observe(run.Duration.Seconds())
+
+	result := "success"
+	switch {
+	case run.Err != "":
+		result = "failed"
+	case run.Errors > 0:
+		result = "errors"
+	default:
+		syncLastSuccess.WithLabelValues(run.Kind).Set(float64(time.Now().Unix()))
+	}
+	syncRuns.WithLabelValues(run.Kind, result).Inc()
+
+	syncUsers.WithLabelValues(run.Kind, "synced").Set(float64(run.Users - run.Errors))
+	syncUsers.WithLabelValues(run.Kind, "skipped").Set(float64(run.Skipped))
+	syncUsers.WithLabelValues(run.Kind, "error").Set(float64(run.Errors))
+
+	for _, reported := range reportedActions {
+		count := plan.Count(reported.action)
+		syncChanges.WithLabelValues(run.Kind, reported.action).Set(float64(count))
+		syncChangesTotal.WithLabelValues(reported.action).Add(float64(count))
+	}
+}
+
+// instrumentedTransport records the latency and status of every Mattermost API call
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (transport instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	endpoint := apiEndpoint(request.URL.Path)
+	start := time.Now()
+
+	response, err := transport.next.RoundTrip(request)
+
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	mattermostRequestDuration.WithLabelValues(request.Method, endpoint).Observe(time.Since(start).Seconds())
+	mattermostRequests.WithLabelValues(request.Method, endpoint, strconv.Itoa(status)).Inc()
+
+	return response, err
+}
+
+// apiEndpoint returns the route of an API path with ids and names replaced by placeholders,
+// e.g. /users/:id/teams for /api/v4/users/8xk3.../teams, to keep the number of label values small
+func apiEndpoint(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/api/v4"), "/")
+	for i, segment := range segments {
+		switch {
+		case model.IsValidId(segment):
+			segments[i] = ":id"
+		case i > 0 && (segments[i-1] == "name" || segments[i-1] == "username" || segments[i-1] == "email"):
+			segments[i] = ":name"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// newMattermostClient returns a Mattermost client recording metrics of its API calls
+func newMattermostClient(url string) *model.Client4 {
+	client := model.NewAPIv4Client(url)
+	client.HttpClient = &http.Client{Transport: instrumentedTransport{next: http.DefaultTransport}}
+
+	return client
+}
+
+// serveMetrics serves the Prometheus metrics at route on a listen address of their own
+func serveMetrics(addr, route string) {
+	mux := http.NewServeMux()
+	mux.Handle(route, promhttp.Handler())
+
+	logging.Infof("Serving metrics on %s%s", addr, route)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logging.Errorf("Could not serve metrics on %s, got error: %+v", addr, err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// defaultNestedGroupDepth is the number of levels of parent groups resolved if nestedGroupDepth is not given
+const defaultNestedGroupDepth = 5
+
+// membershipDirect restricts a mapping to direct members of its groups
+const membershipDirect = "direct"
+
+// groupGraph holds all groups with their members to resolve nested groups, all DNs are normalized
+type groupGraph struct {
+	groups map[string]group
+	// members holds the raw member values per group
+	members map[string][]string
+	// parents holds the groups every group is a member of
+	parents map[string][]string
+}
+
+// resetGroupGraph drops the cached groups, so they are read again by the next sync run
+func (auth *AuthenticatorWithSync) resetGroupGraph() {
+	auth.graphMutex.Lock()
+	defer auth.graphMutex.Unlock()
+
+	auth.groupGraph = nil
+	auth.memberUIDs = nil
+}
+
+// loadGroupGraph returns the groups of the current run, reading them once per run
+func (auth *AuthenticatorWithSync) loadGroupGraph() (*groupGraph, error) {
+	auth.graphMutex.Lock()
+	defer auth.graphMutex.Unlock()
+
+	if auth.groupGraph != nil {
+		return auth.groupGraph, nil
+	}
+
+	schema := auth.groupSchema
+	searchRequest := ldap.NewSearchRequest(
+		auth.groupBaseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		schema.filter("(objectClass=*)"),
+		append(schema.attributes(), schema.memberAttribute()),
+		nil,
+	)
+
+	res, err := auth.authenticator.Connection().SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &groupGraph{
+		groups:  make(map[string]group, len(res.Entries)),
+		members: make(map[string][]string, len(res.Entries)),
+		parents: make(map[string][]string),
+	}
+	for _, entry := range res.Entries {
+		dn := normalizeDN(entry.DN)
+		graph.groups[dn] = schema.toGroup(entry)
+		graph.members[dn] = entry.GetAttributeValues(schema.memberAttribute())
+	}
+
+	for dn, members := range graph.members {
+		for _, member := range members {
+			if member := normalizeDN(member); graph.groups[member].dn != "" {
+				graph.parents[member] = append(graph.parents[member], dn)
+			}
+		}
+	}
+
+	auth.groupGraph = graph
+
+	return graph, nil
+}
+
+// expandGroups adds all groups the given groups are nested in, up to the configured depth. Groups only
+// inherited from a subgroup are marked as nested. Every group is visited once, so cycles end the expansion.
+func (auth *AuthenticatorWithSync) expandGroups(direct []group) ([]group, error) {
+	if !auth.groupSchema.nested || len(direct) == 0 {
+		return direct, nil
+	}
+
+	graph, err := auth.loadGroupGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := append([]group{}, direct...)
+	seen := make(map[string]bool)
+	var level []string
+	for _, group := range direct {
+		dn := normalizeDN(group.dn)
+		seen[dn] = true
+		level = append(level, dn)
+	}
+
+	for depth := 0; depth < auth.groupSchema.nestedDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, dn := range level {
+			for _, parent := range graph.parents[dn] {
+				if seen[parent] {
+					continue
+				}
+				seen[parent] = true
+
+				group := graph.groups[parent]
+				group.nested = true
+				groups = append(groups, group)
+				next = append(next, parent)
+			}
+		}
+		level = next
+	}
+
+	return groups, nil
+}
+
+// nestedMemberUIDs returns the uids of all users in the group with the given DN and its subgroups
+func (auth *AuthenticatorWithSync) nestedMemberUIDs(dn string) []string {
+	graph, err := auth.loadGroupGraph()
+	if err != nil {
+		logging.Errorf("Could not resolve nested groups, got error: %+v", err)
+		return nil
+	}
+
+	var uids []string
+	seen := map[string]bool{normalizeDN(dn): true}
+	level := []string{normalizeDN(dn)}
+	for depth := 0; depth < auth.groupSchema.nestedDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, group := range level {
+			for _, member := range graph.members[group] {
+				normalized := normalizeDN(member)
+				if graph.groups[normalized].dn == "" {
+					if uid := auth.resolveMemberUID(member); uid != "" {
+						uids = append(uids, uid)
+					}
+				} else if !seen[normalized] {
+					seen[normalized] = true
+					next = append(next, normalized)
+				}
+			}
+		}
+		level = next
+	}
+
+	return uids
+}
+
+// isGroupDN returns whether the DN belongs to a known group
+func (auth *AuthenticatorWithSync) isGroupDN(dn string) bool {
+	graph, err := auth.loadGroupGraph()
+	return err == nil && graph.groups[normalizeDN(dn)].dn != ""
+}
+
+// membershipGroups returns the groups counting for a mapping, only the direct ones if direct is set
+func membershipGroups(groups []group, direct bool) []group {
+	if !direct {
+		return groups
+	}
+
+	var directGroups []group
+	for _, group := range groups {
+		if !group.nested {
+			directGroups = append(directGroups, group)
+		}
+	}
+
+	return directGroups
+}
+
+// normalizeDN returns the DN lowercased and without insignificant spaces for comparison
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attributes := make([]string, 0, len(rdn.Attributes))
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		sort.Strings(attributes)
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+
+	return strings.Join(rdns, ",")
+}
@@ -1,5 +1,10 @@
 package oauthenticator
 
+import "errors"
+
+// ErrInvalidCredentials is returned by Authenticate for a wrong username or password, all other errors count as failures of the backend
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 // AuthenticatorBackend interface to provide to a new OAuth server
 type AuthenticatorBackend interface {
 	// Authenticate authenticates the user and returns the unique user identifier
@@ -8,3 +13,9 @@ type AuthenticatorBackend interface {
 	// GetUserById fetches the user object from the backend without
 	GetUserByID(id string) (interface{}, error)
 }
+
+// AvatarBackend is optionally implemented by backends able to serve profile pictures
+type AvatarBackend interface {
+	// GetAvatarByID returns the picture of the user together with its content type
+	GetAvatarByID(id string) ([]byte, string, error)
+}
@@ -0,0 +1,59 @@
+package oauthenticator
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of OAuth requests
+const (
+	outcomeSuccess = "success"
+	// outcomeInvalidCredentials is a login with a wrong username or password
+	outcomeInvalidCredentials = "invalid_credentials"
+	// outcomeRejected is a request refused by the OAuth server, e.g. for an unknown client or an expired code
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "oauth",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of authorize, token and user info requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mattermost_ldap",
+		Subsystem: "oauth",
+		Name:      "requests_total",
+		Help:      "Authorize, token and user info requests by outcome: success, invalid_credentials, rejected or error.",
+	}, []string{"endpoint", "outcome"})
+)
+
+// requestObservation records a request to an OAuth endpoint once it is done
+type requestObservation struct {
+	endpoint string
+	outcome  string
+	start    time.Time
+}
+
+func observeRequest(endpoint string) *requestObservation {
+	return &requestObservation{endpoint: endpoint, outcome: outcomeSuccess, start: time.Now()}
+}
+
+// failed sets the outcome from an error response of the OAuth server
+func (observation *requestObservation) failed(internalError error) {
+	observation.outcome = outcomeRejected
+	if internalError != nil {
+		observation.outcome = outcomeError
+	}
+}
+
+func (observation *requestObservation) finish() {
+	requestDuration.WithLabelValues(observation.endpoint).Observe(time.Since(observation.start).Seconds())
+	requests.WithLabelValues(observation.endpoint, observation.outcome).Inc()
+}
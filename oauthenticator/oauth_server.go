@@ -6,15 +6,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"html/template"
-	"log"
 	"net/http"
-	"os"
 
 	"github.com/RangelReale/osin"
 	mysql "github.com/felipeweb/osin-mysql"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
 )
 
 // Server is a OAuth server
@@ -38,6 +36,25 @@ type Server struct {
 	RouteLogin  string
 	RouteToken  string
 	RouteInfo   string
+	// RouteAvatar serves profile pictures if set and the backend implements AvatarBackend
+	RouteAvatar string
+	// AvatarRateLimit limits the profile pictures served per second, AvatarRateBurst allows short bursts
+	AvatarRateLimit float64
+	AvatarRateBurst int
+	// RouteJwks serves the key signing the id_tokens once EnableOpenID was called
+	RouteJwks string
+
+	// routes are further handlers registered by HandleFunc
+	routes []route
+
+	avatarLimiter *rateLimiter
+	openID        *openIDProvider
+}
+
+type route struct {
+	path    string
+	handler http.HandlerFunc
+	methods []string
 }
 
 // TemplateData determines whether there was an error fullfilling a request
@@ -94,16 +111,23 @@ func (server *Server) RemoveClient(id string) {
 
 // HandleTokenRequest is a http handler to handle to token request
 func (server *Server) HandleTokenRequest(w http.ResponseWriter, r *http.Request) {
+	observation := observeRequest("token")
+	defer observation.finish()
+
 	resp := server.osin.NewResponse()
 	defer resp.Close()
 
 	if ar := server.osin.HandleAccessRequest(resp, r); ar != nil {
 		ar.Authorized = true
 		server.osin.FinishAccessRequest(resp, r, ar)
+		server.addIDToken(resp, ar, r)
 	}
 
+	if resp.IsError {
+		observation.failed(resp.InternalError)
+	}
 	if resp.IsError && resp.InternalError != nil {
-		log.Printf("ERROR: %+v\n", resp.InternalError)
+		logging.FromContext(r.Context()).Errorf("%+v", resp.InternalError)
 	}
 
 	osin.OutputJSON(resp, w, r)
@@ -123,6 +147,9 @@ func (server *Server) HandleTokenInfoRequest(w http.ResponseWriter, r *http.Requ
 
 // HandleUserInfoRequest is a http handler to handle to userinfo request
 func (server *Server) HandleUserInfoRequest(w http.ResponseWriter, r *http.Request) {
+	observation := observeRequest("user_info")
+	defer observation.finish()
+
 	resp := server.osin.NewResponse()
 	defer resp.Close()
 
@@ -132,6 +159,7 @@ func (server *Server) HandleUserInfoRequest(w http.ResponseWriter, r *http.Reque
 			js, err := json.Marshal(user)
 
 			if err != nil {
+				observation.outcome = outcomeError
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -143,15 +171,46 @@ func (server *Server) HandleUserInfoRequest(w http.ResponseWriter, r *http.Reque
 
 		resp.ErrorStatusCode = 500
 		resp.SetError(osin.E_SERVER_ERROR, "")
-		log.Printf("ERROR: %+v\n", resp.InternalError)
+		observation.outcome = outcomeError
+		logging.FromContext(r.Context()).Errorf("%+v", resp.InternalError)
 
 	}
 
+	if resp.IsError && observation.outcome == outcomeSuccess {
+		observation.failed(resp.InternalError)
+	}
 	osin.OutputJSON(resp, w, r)
 }
 
+// HandleAvatarRequest is a http handler serving the profile picture of a user
+func (server *Server) HandleAvatarRequest(w http.ResponseWriter, r *http.Request) {
+	backend, ok := server.authenticator.(AvatarBackend)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !server.avatarLimiter.allow() {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	picture, contentType, err := backend.GetAvatarByID(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(picture)
+}
+
 // HandleAuthorizeRequest is a http handler to handle to authorize request
 func (server *Server) HandleAuthorizeRequest(w http.ResponseWriter, r *http.Request) {
+	observation := observeRequest("authorize")
+	defer observation.finish()
+
 	resp := server.osin.NewResponse()
 	defer resp.Close()
 
@@ -159,6 +218,7 @@ func (server *Server) HandleAuthorizeRequest(w http.ResponseWriter, r *http.Requ
 		err := r.ParseForm()
 		if err != nil {
 			server.osin.FinishAuthorizeRequest(resp, r, ar)
+			observation.failed(resp.InternalError)
 			osin.OutputJSON(resp, w, r)
 			return
 		}
@@ -168,7 +228,11 @@ func (server *Server) HandleAuthorizeRequest(w http.ResponseWriter, r *http.Requ
 		userID, err := server.authenticator.Authenticate(username, password)
 		if err != nil || userID == "" {
 			// serve the login page again if the authentication fails
-			log.Printf("ERROR: Could not authenticate user %s and got error %+v", username, err)
+			observation.outcome = outcomeError
+			if err == ErrInvalidCredentials {
+				observation.outcome = outcomeInvalidCredentials
+			}
+			logging.FromContext(r.Context()).With("user", username).Errorf("Could not authenticate user %s and got error %+v", username, err)
 			ctx := context.WithValue(r.Context(), "hasError", true)
 			ctx = context.WithValue(ctx, "error", "Invalid Credentials.")
 
@@ -180,10 +244,16 @@ func (server *Server) HandleAuthorizeRequest(w http.ResponseWriter, r *http.Requ
 		ar.Authorized = true
 
 		server.osin.FinishAuthorizeRequest(resp, r, ar)
+		if code, ok := resp.Output["code"].(string); ok && server.openID != nil && r.FormValue("nonce") != "" {
+			server.openID.rememberNonce(code, r.FormValue("nonce"), ar.Expiration)
+		}
 	}
 
+	if resp.IsError {
+		observation.failed(resp.InternalError)
+	}
 	if resp.IsError && resp.InternalError != nil {
-		log.Printf("ERROR: %+v\n", resp.InternalError)
+		logging.FromContext(r.Context()).Errorf("%+v", resp.InternalError)
 	}
 
 	osin.OutputJSON(resp, w, r)
@@ -220,9 +290,14 @@ func renderTemplateWithData(templatePath string, w http.ResponseWriter, id strin
 	return true
 }
 
+// HandleFunc registers a further handler served next to the OAuth endpoints
+func (server *Server) HandleFunc(path string, handler http.HandlerFunc, methods ...string) {
+	server.routes = append(server.routes, route{path: path, handler: handler, methods: methods})
+}
+
 // ListenAndServe starts a webserver at the previously defined endpoints
 func (server *Server) ListenAndServe(listen string) {
-	log.Println("Starting Webservice...")
+	logging.Infof("Starting Webservice...")
 
 	r := mux.NewRouter()
 	r.PathPrefix(server.RouteStatic).Handler(http.StripPrefix(server.RouteStatic, http.FileServer(http.Dir(server.StaticPath))))
@@ -230,9 +305,19 @@ func (server *Server) ListenAndServe(listen string) {
 	r.HandleFunc(server.RouteLogin, server.HandleAuthorizeRequest).Methods("POST")
 	r.HandleFunc(server.RouteToken, server.HandleTokenRequest).Methods("POST")
 	r.HandleFunc(server.RouteInfo, server.HandleUserInfoRequest).Methods("GET")
+	if server.RouteAvatar != "" {
+		server.avatarLimiter = newRateLimiter(server.AvatarRateLimit, server.AvatarRateBurst)
+		r.HandleFunc(server.RouteAvatar+"{id}", server.HandleAvatarRequest).Methods("GET")
+	}
+	if server.openID != nil {
+		r.HandleFunc(RouteDiscovery, server.HandleDiscoveryRequest).Methods("GET")
+		r.HandleFunc(server.RouteJwks, server.HandleJwksRequest).Methods("GET")
+	}
+	for _, route := range server.routes {
+		r.HandleFunc(route.path, route.handler).Methods(route.methods...)
+	}
 
 	// Start http server
-	log.Println("Listening on " + listen)
-	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
-	http.ListenAndServe(listen, loggedRouter)
+	logging.Infof("Listening on %s", listen)
+	http.ListenAndServe(listen, logRequests(r))
 }
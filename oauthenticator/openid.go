@@ -0,0 +1,257 @@
+package oauthenticator
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// RouteDiscovery is where OpenID Connect clients look up the endpoints of the provider
+const RouteDiscovery = "/.well-known/openid-configuration"
+
+// scopeOpenID is requested by clients expecting an id_token
+const scopeOpenID = "openid"
+
+// openIDProvider signs the id_tokens and remembers the nonces of pending authorization codes
+type openIDProvider struct {
+	issuer string
+	key    *rsa.PrivateKey
+	keyID  string
+
+	nonceMutex sync.Mutex
+	nonces     map[string]pendingNonce
+}
+
+type pendingNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// LoadOpenIDKey reads a PEM encoded RSA private key (PKCS#1 or PKCS#8). Without a path an ephemeral key is
+// generated, the id_tokens issued before a restart can't be verified anymore then.
+func LoadOpenIDKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the private key in %s: %s", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key in %s is no RSA key", path)
+	}
+	return key, nil
+}
+
+// EnableOpenID turns the server into an OpenID Connect provider. The discovery document is served at RouteDiscovery,
+// the signing key at RouteJwks, which has to be set before, and the token endpoint adds an id_token if the scope
+// openid was requested.
+// The backend's GetUserByID has to return the claims of the user including sub.
+func (server *Server) EnableOpenID(issuer string, key *rsa.PrivateKey) error {
+	if issuer == "" {
+		return errors.New("OpenID Connect needs the public URL of the server as issuer")
+	}
+	if key == nil {
+		return errors.New("OpenID Connect needs a signing key")
+	}
+	if server.RouteJwks == "" {
+		return errors.New("OpenID Connect needs a route serving the signing key")
+	}
+
+	server.openID = &openIDProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		key:    key,
+		keyID:  keyID(&key.PublicKey),
+		nonces: make(map[string]pendingNonce),
+	}
+	return nil
+}
+
+// keyID derives a stable identifier from the public key
+func keyID(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(key.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// HandleDiscoveryRequest is a http handler serving the OpenID Connect discovery document
+func (server *Server) HandleDiscoveryRequest(w http.ResponseWriter, r *http.Request) {
+	provider := server.openID
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                provider.issuer,
+		"authorization_endpoint":                provider.issuer + server.RouteLogin,
+		"token_endpoint":                        provider.issuer + server.RouteToken,
+		"userinfo_endpoint":                     provider.issuer + server.RouteInfo,
+		"jwks_uri":                              provider.issuer + server.RouteJwks,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{scopeOpenID, "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "iat", "exp", "nonce", "email", "email_verified", "name", "given_name", "family_name", "nickname", "preferred_username", "locale", "picture"},
+	})
+}
+
+// HandleJwksRequest is a http handler serving the public key the id_tokens are signed with
+func (server *Server) HandleJwksRequest(w http.ResponseWriter, r *http.Request) {
+	key := &server.openID.key.PublicKey
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": server.openID.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// rememberNonce keeps the nonce of an authorize request until its code is exchanged or expired
+func (provider *openIDProvider) rememberNonce(code, nonce string, expiresIn int32) {
+	provider.nonceMutex.Lock()
+	defer provider.nonceMutex.Unlock()
+
+	now := time.Now()
+	for pending, entry := range provider.nonces {
+		if now.After(entry.expires) {
+			delete(provider.nonces, pending)
+		}
+	}
+	provider.nonces[code] = pendingNonce{nonce: nonce, expires: now.Add(time.Duration(expiresIn) * time.Second)}
+}
+
+// takeNonce returns and forgets the nonce stored for the code
+func (provider *openIDProvider) takeNonce(code string) string {
+	provider.nonceMutex.Lock()
+	defer provider.nonceMutex.Unlock()
+
+	entry, ok := provider.nonces[code]
+	delete(provider.nonces, code)
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.nonce
+}
+
+// idToken builds the signed id_token for a finished access request
+func (server *Server) idToken(ar *osin.AccessRequest) (string, error) {
+	provider := server.openID
+
+	user, err := server.authenticator.GetUserByID(ar.UserData.(string))
+	if err != nil {
+		return "", err
+	}
+	js, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(js, &claims); err != nil {
+		return "", err
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return "", errors.New("the user data contains no sub claim")
+	}
+
+	now := time.Now()
+	claims["iss"] = provider.issuer
+	claims["aud"] = ar.Client.GetId()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(ar.Expiration) * time.Second).Unix()
+	if ar.Type == osin.AUTHORIZATION_CODE {
+		if nonce := provider.takeNonce(ar.Code); nonce != "" {
+			claims["nonce"] = nonce
+		}
+	}
+
+	return provider.sign(claims)
+}
+
+// sign encodes the claims as JWT signed with RS256
+func (provider *openIDProvider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": provider.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// hasScope reports whether the space separated scopes contain scope
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// addIDToken adds the id_token to a successful token response if the client asked for it
+func (server *Server) addIDToken(resp *osin.Response, ar *osin.AccessRequest, r *http.Request) {
+	if server.openID == nil || resp.IsError || !hasScope(ar.Scope, scopeOpenID) {
+		return
+	}
+
+	token, err := server.idToken(ar)
+	if err != nil {
+		resp.SetError(osin.E_SERVER_ERROR, "")
+		resp.InternalError = err
+		return
+	}
+	resp.Output["id_token"] = token
+	logging.FromContext(r.Context()).Debugf("Issued an id_token for client %s", ar.Client.GetId())
+}
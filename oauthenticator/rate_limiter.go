@@ -0,0 +1,49 @@
+package oauthenticator
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultAvatarRateLimit is the number of profile pictures served per second if no limit is configured
+const defaultAvatarRateLimit = 20
+
+// rateLimiter is a token bucket rejecting requests beyond its rate
+type rateLimiter struct {
+	mutex sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		rate = defaultAvatarRateLimit
+	}
+
+	if burst < 1 {
+		burst = int(rate)
+	}
+
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token and returns whether the request may be served
+func (limiter *rateLimiter) allow() bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+
+	return true
+}
@@ -0,0 +1,52 @@
+package oauthenticator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// requestIDHeader carries the id correlating the log lines of a request, an id set by a proxy is kept
+const requestIDHeader = "X-Request-ID"
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests tags every request with a request id, passes a logger carrying it to the handlers and logs the request
+// once it is done. The query is left out, it may carry codes and tokens.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := logging.With("request_id", id)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(logging.NewContext(r.Context(), logger)))
+
+		logger.With("method", r.Method, "path", r.URL.Path, "status", recorder.status, "duration", time.Since(start)).
+			Infof("%s %s", r.Method, r.URL.Path)
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
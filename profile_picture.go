@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"sync"
+
+	// register further formats for image.Decode
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// defaultPictureSize is the maximum width and height of uploaded profile pictures
+const defaultPictureSize = 512
+
+// maxCachedPictures bounds the converted pictures kept in memory, the cache is emptied once it is full
+const maxCachedPictures = 1000
+
+// errNoAvatar is returned for users without a picture or disabled in LDAP
+var errNoAvatar = errors.New("user has no picture")
+
+// pictureCache holds converted pictures by the hash of the raw LDAP picture
+type pictureCache struct {
+	mutex    sync.Mutex
+	pictures map[string][]byte
+}
+
+// convertedPicture returns the raw picture converted for Mattermost, converting every picture only once
+func (auth *AuthenticatorWithSync) convertedPicture(raw []byte) ([]byte, error) {
+	hash := pictureHash(raw)
+
+	cache := auth.pictureCache
+	cache.mutex.Lock()
+	picture, cached := cache.pictures[hash]
+	cache.mutex.Unlock()
+	if cached {
+		return picture, nil
+	}
+
+	picture, err := convertPicture(raw, auth.pictureSize)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.pictures == nil || len(cache.pictures) >= maxCachedPictures {
+		cache.pictures = make(map[string][]byte)
+	}
+	cache.pictures[hash] = picture
+
+	return picture, nil
+}
+
+// convertPicture decodes the raw picture, scales it down to fit into size x size pixels and encodes it as JPEG
+func convertPicture(raw []byte, size int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= 0 {
+		size = defaultPictureSize
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, scaleDown(img, size), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// scaleDown shrinks img preserving its aspect ratio by averaging all source pixels covered by a target pixel
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+
+	newWidth, newHeight := size, size
+	if width > height {
+		newHeight = maxInt(1, height*size/width)
+	} else {
+		newWidth = maxInt(1, width*size/height)
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/newHeight, bounds.Min.Y+(y+1)*height/newHeight
+		for x := 0; x < newWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/newWidth, bounds.Min.X+(x+1)*width/newWidth
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < maxInt(y1, y0+1); sy++ {
+				for sx := x0; sx < maxInt(x1, x0+1); sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+
+			scaled.Set(x, y, color.RGBA64{R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count)})
+		}
+	}
+
+	return scaled
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func pictureHash(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// syncPictureForUser uploads the LDAP picture of the user if it changed since the last upload
+func (auth *AuthenticatorWithSync) syncPictureForUser(user *model.User, data userData) error {
+	if auth.transformer.PictureAttrName == "" {
+		return nil
+	}
+
+	storedHash, err := auth.state.Get(bucketPictureHash, user.Id)
+	if err != nil {
+		logging.Errorf("Could not read picture hash of user %s, got error: %+v", user.Username, err)
+		return err
+	}
+
+	raw, err := auth.fetchPicture(data.UID)
+	if err != nil {
+		logging.Errorf("Could not fetch picture of user %s, got error: %+v", user.Username, err)
+		return err
+	}
+
+	if len(raw) == 0 {
+		if storedHash == "" {
+			return nil
+		}
+
+		// the picture has been removed from LDAP
+		if !auth.planChange(actionUpdatePicture, user.Username, "", "default") {
+			return nil
+		}
+
+		if _, resp := auth.Mattermost().SetDefaultProfileImage(user.Id); resp.Error != nil {
+			logging.Errorf("Could not reset profile picture of user %s, got error: %+v", user.Username, resp.Error)
+			auth.changeFailed(actionUpdatePicture, user.Username, "")
+			return resp.Error
+		}
+
+		if err := auth.state.Delete(bucketPictureHash, user.Id); err != nil {
+			logging.Errorf("Could not store picture hash of user %s, got error: %+v", user.Username, err)
+		}
+		return nil
+	}
+
+	hash := pictureHash(raw)
+	if hash == storedHash {
+		return nil
+	}
+
+	picture, err := auth.convertedPicture(raw)
+	if err != nil {
+		logging.Errorf("Could not convert picture of user %s, got error: %+v", user.Username, err)
+		return err
+	}
+
+	if !auth.planChange(actionUpdatePicture, user.Username, "", hash[:12]) {
+		return nil
+	}
+
+	if _, resp := auth.Mattermost().SetProfileImage(user.Id, picture); resp.Error != nil {
+		logging.Errorf("Could not upload profile picture of user %s, got error: %+v", user.Username, resp.Error)
+		auth.changeFailed(actionUpdatePicture, user.Username, "")
+		return resp.Error
+	}
+
+	if err := auth.state.Set(bucketPictureHash, user.Id, hash); err != nil {
+		logging.Errorf("Could not store picture hash of user %s, got error: %+v", user.Username, err)
+	}
+
+	logging.Infof("Updated profile picture of user %s", user.Username)
+
+	return nil
+}
+
+// fetchPicture loads the raw LDAP picture of the user, it is not part of the regular user searches to keep them small
+func (auth *AuthenticatorWithSync) fetchPicture(uid string) ([]byte, error) {
+	if auth.transformer.PictureAttrName == "" {
+		return nil, nil
+	}
+
+	entry, err := auth.authenticator.GetUserEntry(uid, []string{auth.transformer.PictureAttrName})
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.transformer.picture(entry), nil
+}
+
+// avatarID returns the id of the user's avatar URL: the uid followed by its signature, so URLs cannot be guessed
+func (auth *AuthenticatorWithSync) avatarID(uid string) string {
+	return uid + "." + auth.avatarSignature(uid)
+}
+
+func (auth *AuthenticatorWithSync) avatarSignature(uid string) string {
+	mac := hmac.New(sha256.New, auth.avatarSecret)
+	mac.Write([]byte(uid))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// GetAvatarByID returns the converted LDAP picture of the user as JPEG, id is the signed id of the avatar URL
+func (auth *AuthenticatorWithSync) GetAvatarByID(avatarID string) ([]byte, string, error) {
+	separator := strings.LastIndex(avatarID, ".")
+	if separator < 0 {
+		return nil, "", errNoAvatar
+	}
+
+	id := avatarID[:separator]
+	if !hmac.Equal([]byte(avatarID[separator+1:]), []byte(auth.avatarSignature(id))) {
+		return nil, "", errNoAvatar
+	}
+
+	user, err := auth.authenticator.GetUserByID(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !user.(userData).isActive() {
+		return nil, "", errNoAvatar
+	}
+
+	raw, err := auth.fetchPicture(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(raw) == 0 {
+		return nil, "", errNoAvatar
+	}
+
+	picture, err := auth.convertedPicture(raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return picture, "image/jpeg", nil
+}
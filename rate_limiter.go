@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// rateLimiter is a token bucket limiting the rate of Mattermost API calls. It counts all calls and the time spent waiting.
+type rateLimiter struct {
+	mutex sync.Mutex
+
+	// rate in calls per second, unlimited if not positive
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	calls  int64
+	waited time.Duration
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until the next call is allowed
+func (limiter *rateLimiter) wait() {
+	limiter.mutex.Lock()
+	limiter.calls++
+
+	if limiter.rate <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+
+	// reserve a token, a negative balance is paid off by waiting
+	limiter.tokens--
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+		limiter.waited += delay
+	}
+	limiter.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+// counters returns the number of calls and the total time spent waiting so far
+func (limiter *rateLimiter) counters() (int64, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.calls, limiter.waited
+}
+
+// mattermostConnection guards the Mattermost client shared by the sync workers and rate limits its use
+type mattermostConnection struct {
+	mutex   sync.RWMutex
+	client  *model.Client4
+	limiter *rateLimiter
+}
+
+func (conn *mattermostConnection) get() *model.Client4 {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
+	return conn.client
+}
+
+func (conn *mattermostConnection) set(client *model.Client4) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.client = client
+}
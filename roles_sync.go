@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// systemGuestRoleID is the role of Mattermost guest accounts
+const systemGuestRoleID = "system_guest"
+
+// ConfigureRoles applies the roles and teamAdmins sections of the configuration
+func (auth *AuthenticatorWithSync) ConfigureRoles(roles RolesConfig, teamAdmins map[string]*TeamAdminsConfig) {
+	auth.rolesConfig = roles
+	auth.teamAdminGroups = make(map[string][]string)
+	auth.teamAdminDirect = make(map[string]bool)
+
+	for team, admins := range teamAdmins {
+		auth.teamAdminGroups[team] = admins.Group
+		auth.teamAdminDirect[team] = strings.EqualFold(admins.Membership, membershipDirect)
+	}
+}
+
+// inAnyGroup returns whether one of the given groups has one of the given uids
+func inAnyGroup(groups []group, uids []string) bool {
+	for _, group := range groups {
+		for _, uid := range uids {
+			if group.uid == uid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// syncRolesForUser grants and reverts system and team roles according to the configured LDAP groups
+func (auth *AuthenticatorWithSync) syncRolesForUser(user *model.User, groups []group) error {
+	var errs syncErrors
+	errs.add(auth.syncSystemRolesForUser(user, groups))
+
+	teams := make([]string, 0, len(auth.teamAdminGroups))
+	for team := range auth.teamAdminGroups {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+
+	for _, teamName := range teams {
+		admin := inAnyGroup(membershipGroups(groups, auth.teamAdminDirect[teamName]), auth.teamAdminGroups[teamName])
+		errs.add(auth.syncTeamAdminForUser(user, teamName, admin))
+	}
+
+	return errs.err()
+}
+
+// systemRoleContainer keys the system admin role granted by the sync in bucketManagedAdminRole
+const systemRoleContainer = "system"
+
+// syncSystemRolesForUser grants the system admin role to members of the admin groups. Only roles granted by the sync are reverted.
+func (auth *AuthenticatorWithSync) syncSystemRolesForUser(user *model.User, groups []group) error {
+	if len(auth.rolesConfig.SystemAdminGroup) == 0 || isGuestUser(user) {
+		// system roles are not managed by the sync, guests are demoted and promoted by syncGuestForUser
+		return nil
+	}
+
+	groups = membershipGroups(groups, strings.EqualFold(auth.rolesConfig.Membership, membershipDirect))
+
+	roles := make(map[string]bool)
+	for _, role := range strings.Fields(user.Roles) {
+		roles[role] = true
+	}
+
+	admin := inAnyGroup(groups, auth.rolesConfig.SystemAdminGroup)
+	if admin == roles[model.SYSTEM_ADMIN_ROLE_ID] {
+		return nil
+	}
+	if !admin && !auth.isManaged(bucketManagedAdminRole, systemRoleContainer, user.Id) {
+		// the role has been granted by an admin
+		return nil
+	}
+	roles[model.SYSTEM_ADMIN_ROLE_ID] = admin
+
+	var newRoles []string
+	for role, granted := range roles {
+		if granted {
+			newRoles = append(newRoles, role)
+		}
+	}
+	sort.Strings(newRoles)
+
+	currentRoles := strings.Fields(user.Roles)
+	sort.Strings(currentRoles)
+	if strings.Join(newRoles, " ") == strings.Join(currentRoles, " ") {
+		return nil
+	}
+
+	if !auth.planChange(actionUpdateUserRoles, user.Username, "", user.Roles+" -> "+strings.Join(newRoles, " ")) {
+		return nil
+	}
+
+	if _, resp := auth.Mattermost().UpdateUserRoles(user.Id, strings.Join(newRoles, " ")); resp.Error != nil {
+		logging.Errorf("Could not update roles of user %s, got error: %+v", user.Username, resp.Error)
+		auth.changeFailed(actionUpdateUserRoles, user.Username, "")
+		return resp.Error
+	}
+
+	logging.Infof("Updated roles of user %s to %s", user.Username, strings.Join(newRoles, " "))
+	user.Roles = strings.Join(newRoles, " ")
+	if admin {
+		auth.markManaged(bucketManagedAdminRole, systemRoleContainer, user.Id)
+	} else {
+		auth.forgetManaged(bucketManagedAdminRole, systemRoleContainer, user.Id)
+	}
+
+	return nil
+}
+
+// syncTeamAdminForUser grants or reverts the team admin role if the user is a member of the team.
+// Only roles granted by the sync are reverted.
+func (auth *AuthenticatorWithSync) syncTeamAdminForUser(user *model.User, teamName string, admin bool) error {
+	logger := logging.With("user", user.Username, "team", teamName)
+
+	team, resp := auth.Mattermost().GetTeamByName(teamName, "")
+	if resp.Error != nil {
+		if resp.StatusCode != 404 {
+			logger.Errorf("Could not find team %s, got error: %+v", teamName, resp.Error)
+			return resp.Error
+		}
+		return nil
+	}
+
+	member, resp := auth.Mattermost().GetTeamMember(team.Id, user.Id, "")
+	if resp.Error != nil {
+		if resp.StatusCode != 404 {
+			logger.Errorf("Could not fetch membership of %s in team %s, got error: %+v", user.Username, teamName, resp.Error)
+			return resp.Error
+		}
+		return nil
+	}
+
+	isAdmin := member.SchemeAdmin || strings.Contains(member.Roles, model.TEAM_ADMIN_ROLE_ID)
+	if isAdmin == admin {
+		return nil
+	}
+	if !admin && !auth.isManaged(bucketManagedAdminRole, team.Id, user.Id) {
+		// the role has been granted by an admin
+		return nil
+	}
+
+	detail := model.TEAM_USER_ROLE_ID
+	if admin {
+		detail = model.TEAM_ADMIN_ROLE_ID
+	}
+
+	if !auth.planChange(actionUpdateTeamRoles, user.Username, teamName, detail) {
+		return nil
+	}
+
+	schemeRoles := model.SchemeRoles{SchemeAdmin: admin, SchemeUser: true}
+	if _, resp := auth.Mattermost().UpdateTeamMemberSchemeRoles(team.Id, user.Id, &schemeRoles); resp.Error != nil {
+		logger.Errorf("Could not update roles of user %s in team %s, got error: %+v", user.Username, teamName, resp.Error)
+		auth.changeFailed(actionUpdateTeamRoles, user.Username, teamName)
+		return resp.Error
+	}
+
+	logger.Infof("Updated role of user %s in team %s to %s", user.Username, teamName, detail)
+	if admin {
+		auth.markManaged(bucketManagedAdminRole, team.Id, user.Id)
+	} else {
+		auth.forgetManaged(bucketManagedAdminRole, team.Id, user.Id)
+	}
+
+	return nil
+}
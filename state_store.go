@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// Buckets of the state store
+const (
+	// bucketPictureHash holds the hash of the last uploaded profile picture per Mattermost user id
+	bucketPictureHash = "picture-hash"
+	// bucketSync holds the high-water mark and the time of the last full sync
+	bucketSync = "sync"
+	// bucketGroupMembers holds the member list per group DN as seen by the last sync
+	bucketGroupMembers = "group-members"
+	// bucketManagedTeamMember and bucketManagedChannelMember hold the memberships created or adopted by the sync,
+	// keyed by team or channel id and user id
+	bucketManagedTeamMember    = "managed-team-member"
+	bucketManagedChannelMember = "managed-channel-member"
+	// bucketManagedAdminRole holds the admin roles granted by the sync, keyed by team id or system and user id
+	bucketManagedAdminRole = "managed-admin-role"
+	// bucketUserHash holds the fingerprint of every user as of their last sync without changes
+	bucketUserHash = "user-hash"
+	// bucketTeamBinding holds the team bound to every LDAP group by the group's uid
+	bucketTeamBinding = "team-binding"
+	// bucketTeamName holds the group uid bound to every team name, so no two groups share a team
+	bucketTeamName = "team-name"
+	// bucketFailedUsers holds the error of the last sync per LDAP uid of users failing to sync
+	bucketFailedUsers = "failed-users"
+	// bucketMissingSince holds the time every Mattermost user was first found missing or disabled in LDAP
+	bucketMissingSince = "missing-since"
+)
+
+// stateStore persists sync state between runs as string values grouped into buckets
+type stateStore interface {
+	// Get returns the stored value or "" if there is none
+	Get(bucket, key string) (string, error)
+	Set(bucket, key, value string) error
+	Delete(bucket, key string) error
+	// Keys returns all keys of the bucket
+	Keys(bucket string) ([]string, error)
+}
+
+// stateFlusher is implemented by state stores buffering their changes
+type stateFlusher interface {
+	// Flush persists all buffered changes
+	Flush() error
+}
+
+// stateFlushInterval is the interval changes made outside of sync runs are written to the state file
+const stateFlushInterval = 30 * time.Second
+
+// fileStateStore keeps the state in memory and writes it to a JSON file once per run and every stateFlushInterval.
+// An empty path keeps the state in memory only.
+type fileStateStore struct {
+	path string
+
+	mutex sync.Mutex
+	state map[string]map[string]string
+	// dirty is set if the state changed since it was written
+	dirty bool
+}
+
+func newFileStateStore(path string) (*fileStateStore, error) {
+	store := &fileStateStore{path: path, state: make(map[string]map[string]string)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &store.state); err != nil {
+			return nil, err
+		}
+	}
+
+	// the flusher must not run before the state is loaded, it would overwrite the file with an empty state
+	go store.flushPeriodically()
+
+	return store, nil
+}
+
+// Get returns the stored value or "" if there is none
+func (store *fileStateStore) Get(bucket, key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.state[bucket][key], nil
+}
+
+// Set stores the value, it is persisted by the next flush
+func (store *fileStateStore) Set(bucket, key, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.state[bucket] == nil {
+		store.state[bucket] = make(map[string]string)
+	}
+	store.state[bucket][key] = value
+	store.dirty = true
+
+	return nil
+}
+
+// Delete removes the value, the change is persisted by the next flush
+func (store *fileStateStore) Delete(bucket, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, found := store.state[bucket][key]; !found {
+		return nil
+	}
+	delete(store.state[bucket], key)
+	store.dirty = true
+
+	return nil
+}
+
+// Keys returns all keys of the bucket
+func (store *fileStateStore) Keys(bucket string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	keys := make([]string, 0, len(store.state[bucket]))
+	for key := range store.state[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Flush writes the state if it changed since it was last written
+func (store *fileStateStore) Flush() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if !store.dirty {
+		return nil
+	}
+
+	if err := store.save(); err != nil {
+		return err
+	}
+	store.dirty = false
+
+	return nil
+}
+
+// flushPeriodically writes the changes of syncs outside of runs, e.g. on login or by the listener
+func (store *fileStateStore) flushPeriodically() {
+	for range time.Tick(stateFlushInterval) {
+		if err := store.Flush(); err != nil {
+			logging.Errorf("Could not write the state file %s, got error: %+v", store.path, err)
+		}
+	}
+}
+
+// save writes the state to a temporary file first to never leave a truncated file behind
+func (store *fileStateStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(store.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(store.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(store.path+".tmp", store.path)
+}
+
+// stateLock is kept open for the lifetime of the process, closing it releases the lock
+var stateLock *os.File
+
+// lockStateFile takes an exclusive lock on a file next to the state file, so a sync run from the command line
+// never overlaps with the server and both never overwrite each other's state. The state file itself cannot be
+// locked since it is replaced on every write.
+func lockStateFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return fmt.Errorf("the state file %s is in use by another process, trigger the sync at the running server instead", path)
+	}
+	stateLock = file
+
+	return nil
+}
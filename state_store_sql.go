@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// register the SQLite driver for the sqlite state store
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStateStore keeps the sync state and the run history in MySQL or SQLite
+type sqlStateStore struct {
+	db     *sql.DB
+	prefix string
+}
+
+// syncRun is an entry of the run history
+type syncRun struct {
+	Kind     string
+	Started  time.Time
+	Duration time.Duration
+	Users    int
+	Skipped  int
+	Errors   int
+	APICalls int64
+	Err      string
+}
+
+// runRecorder is implemented by state stores keeping a history of sync runs
+type runRecorder interface {
+	RecordRun(run syncRun) error
+}
+
+// newSQLStateStore creates the tables of the store if necessary, driver is either mysql or sqlite3
+func newSQLStateStore(db *sql.DB, driver, prefix string) (*sqlStateStore, error) {
+	autoIncrement := "BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY"
+	if driver == "sqlite3" {
+		autoIncrement = "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+
+	store := &sqlStateStore{db: db, prefix: prefix}
+	schemas := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %ssync_state (
+			bucket VARCHAR(64) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (bucket, name)
+		)`, prefix),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %ssync_runs (
+			id %s,
+			kind VARCHAR(16) NOT NULL,
+			started DATETIME NOT NULL,
+			duration_ms BIGINT NOT NULL,
+			users INT NOT NULL,
+			skipped INT NOT NULL,
+			errors INT NOT NULL,
+			api_calls BIGINT NOT NULL,
+			error TEXT NOT NULL
+		)`, prefix, autoIncrement),
+	}
+
+	for _, schema := range schemas {
+		if _, err := db.Exec(schema); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// openStateStore opens the state store configured by kind: file (the default), mysql sharing the OAuth database or sqlite
+func openStateStore(config SyncConfig, mysqlDB *sql.DB, mysqlPrefix string) (stateStore, error) {
+	switch config.StateStore {
+	case "", "file":
+		return newFileStateStore(config.StateFile)
+
+	case "mysql":
+		return newSQLStateStore(mysqlDB, "mysql", mysqlPrefix)
+
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		// SQLite does not support concurrent writers
+		db.SetMaxOpenConns(1)
+
+		return newSQLStateStore(db, "sqlite3", "")
+	}
+
+	return nil, fmt.Errorf("unknown state store %s", config.StateStore)
+}
+
+// Get returns the stored value or "" if there is none
+func (store *sqlStateStore) Get(bucket, key string) (string, error) {
+	var value string
+	err := store.db.QueryRow(fmt.Sprintf("SELECT value FROM %ssync_state WHERE bucket = ? AND name = ?", store.prefix), bucket, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return value, err
+}
+
+// Set stores the value
+func (store *sqlStateStore) Set(bucket, key, value string) error {
+	_, err := store.db.Exec(fmt.Sprintf("REPLACE INTO %ssync_state (bucket, name, value) VALUES (?, ?, ?)", store.prefix), bucket, key, value)
+	return err
+}
+
+// Delete removes the value
+func (store *sqlStateStore) Delete(bucket, key string) error {
+	_, err := store.db.Exec(fmt.Sprintf("DELETE FROM %ssync_state WHERE bucket = ? AND name = ?", store.prefix), bucket, key)
+	return err
+}
+
+// Keys returns all keys of the bucket
+func (store *sqlStateStore) Keys(bucket string) ([]string, error) {
+	rows, err := store.db.Query(fmt.Sprintf("SELECT name FROM %ssync_state WHERE bucket = ? ORDER BY name", store.prefix), bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RecordRun appends the run to the history
+func (store *sqlStateStore) RecordRun(run syncRun) error {
+	_, err := store.db.Exec(
+		fmt.Sprintf("INSERT INTO %ssync_runs (kind, started, duration_ms, users, skipped, errors, api_calls, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", store.prefix),
+		run.Kind, run.Started.UTC(), run.Duration.Milliseconds(), run.Users, run.Skipped, run.Errors, run.APICalls, run.Err)
+	return err
+}
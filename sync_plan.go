@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+)
+
+// Actions the sync may perform on Mattermost
+const (
+	actionCreateUser        = "create-user"
+	actionPatchUser         = "patch-user"
+	actionConflict          = "conflict"
+	actionMigrateUser       = "migrate-user"
+	actionUpdateAuthService = "update-auth-service"
+	actionDeactivateUser    = "deactivate-user"
+	// actionDeactivationPending is a missing user waiting for the grace period to pass
+	actionDeactivationPending = "deactivation-pending"
+	actionReactivateUser      = "reactivate-user"
+	actionDemoteUser          = "demote-user"
+	actionPromoteUser         = "promote-user"
+	actionUpdateUserRoles     = "update-user-roles"
+	actionUpdatePicture       = "update-picture"
+	actionCreateTeam          = "create-team"
+	actionAddTeamMember       = "add-team-member"
+	actionRemoveTeamMember    = "remove-team-member"
+	actionUpdateTeamRoles     = "update-team-roles"
+	actionRenameTeam          = "rename-team"
+	actionArchiveTeam         = "archive-team"
+	actionRestoreTeam         = "restore-team"
+
+	actionCreateChannel       = "create-channel"
+	actionAddChannelMember    = "add-channel-member"
+	actionRemoveChannelMember = "remove-channel-member"
+
+	actionCreateUserGroup       = "create-user-group"
+	actionAddUserGroupMember    = "add-user-group-member"
+	actionRemoveUserGroupMember = "remove-user-group-member"
+)
+
+// plannedChange is a single change the sync intends to apply to Mattermost
+type plannedChange struct {
+	Action string `json:"action"`
+	User   string `json:"user,omitempty"`
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// syncPlan collects all changes of a sync run
+type syncPlan struct {
+	mutex   sync.Mutex
+	changes []plannedChange
+}
+
+func newSyncPlan() *syncPlan {
+	return &syncPlan{}
+}
+
+func (plan *syncPlan) record(action, user, target, detail string) {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+
+	plan.changes = append(plan.changes, plannedChange{Action: action, User: user, Target: target, Detail: detail})
+}
+
+// drop removes the last recorded change with the given action, user and target
+func (plan *syncPlan) drop(action, user, target string) {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+
+	for i := len(plan.changes) - 1; i >= 0; i-- {
+		change := plan.changes[i]
+		if change.Action == action && change.User == user && change.Target == target {
+			plan.changes = append(plan.changes[:i], plan.changes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Changes returns a copy of all recorded changes
+func (plan *syncPlan) Changes() []plannedChange {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+
+	return append([]plannedChange(nil), plan.changes...)
+}
+
+// Count returns the number of recorded changes with the given action
+func (plan *syncPlan) Count(action string) int {
+	count := 0
+	for _, change := range plan.Changes() {
+		if change.Action == action {
+			count++
+		}
+	}
+
+	return count
+}
+
+// CountFor returns the number of recorded changes of the given users
+func (plan *syncPlan) CountFor(users ...string) int {
+	count := 0
+	for _, change := range plan.Changes() {
+		for _, user := range users {
+			if change.User == user {
+				count++
+				break
+			}
+		}
+	}
+
+	return count
+}
+
+// WriteTable writes the plan as a human-readable table
+func (plan *syncPlan) WriteTable(w io.Writer) error {
+	changes := plan.Changes()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tUSER\tTARGET\tDETAIL")
+	for _, change := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change.Action, change.User, change.Target, change.Detail)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d changes in total.\n", len(changes))
+	return err
+}
+
+// WriteJSON writes the plan as JSON array
+func (plan *syncPlan) WriteJSON(w io.Writer) error {
+	changes := plan.Changes()
+	if changes == nil {
+		changes = []plannedChange{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(changes)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// reportedActions are the plan actions summarized by the run report, in order
+var reportedActions = []struct {
+	action string
+	label  string
+}{
+	{actionCreateUser, "Users created"},
+	{actionPatchUser, "Users updated"},
+	{actionDeactivateUser, "Users deactivated"},
+	{actionDeactivationPending, "Deactivations pending"},
+	{actionReactivateUser, "Users reactivated"},
+	{actionDemoteUser, "Users demoted to guests"},
+	{actionPromoteUser, "Guests promoted"},
+	{actionCreateTeam, "Teams created"},
+	{actionRenameTeam, "Teams renamed"},
+	{actionArchiveTeam, "Teams archived"},
+	{actionRestoreTeam, "Teams restored"},
+	{actionAddTeamMember, "Team memberships added"},
+	{actionRemoveTeamMember, "Team memberships removed"},
+	{actionCreateChannel, "Channels created"},
+	{actionAddChannelMember, "Channel memberships added"},
+	{actionRemoveChannelMember, "Channel memberships removed"},
+	{actionCreateUserGroup, "User groups created"},
+	{actionAddUserGroupMember, "User group memberships added"},
+	{actionRemoveUserGroupMember, "User group memberships removed"},
+	{actionConflict, "Conflicts"},
+}
+
+// ConfigureReport sets where the summary of every sync run is posted to
+func (auth *AuthenticatorWithSync) ConfigureReport(config ReportConfig) {
+	auth.reportConfig = config
+}
+
+// reportRun posts the summary of the finished run to the configured channel or webhook
+func (auth *AuthenticatorWithSync) reportRun(stats *syncStats, plan *syncPlan) {
+	config := auth.reportConfig
+	if auth.dryRun || (config.Channel == "" && config.WebhookURL == "") {
+		return
+	}
+
+	run := stats.run()
+	failed := run.Err != "" || run.Errors > 0
+	alert := run.Err != "" || (config.ErrorThreshold > 0 && run.Errors >= config.ErrorThreshold)
+	if config.OnlyFailures && !failed {
+		return
+	}
+
+	message := formatReport(run, plan, alert, config.AlertMention)
+
+	var err error
+	if config.WebhookURL != "" {
+		err = postWebhook(config.WebhookURL, message)
+	} else {
+		err = auth.postToChannel(config.Channel, message)
+	}
+
+	if err != nil {
+		logging.Errorf("Could not post the sync report, got error: %+v", err)
+	}
+}
+
+func formatReport(run syncRun, plan *syncPlan, alert bool, mention string) string {
+	var report strings.Builder
+
+	if alert {
+		if mention != "" {
+			report.WriteString(mention + " ")
+		}
+		report.WriteString(":warning: ")
+	}
+	fmt.Fprintf(&report, "#### LDAP sync (%s) finished in %s\n\n", run.Kind, run.Duration.Round(time.Second))
+
+	fmt.Fprintf(&report, "| | |\n|:--|--:|\n")
+	fmt.Fprintf(&report, "| Users synced | %d |\n", run.Users)
+	fmt.Fprintf(&report, "| Users unchanged | %d |\n", run.Skipped)
+	for _, reported := range reportedActions {
+		if count := plan.Count(reported.action); count > 0 {
+			fmt.Fprintf(&report, "| %s | %d |\n", reported.label, count)
+		}
+	}
+	fmt.Fprintf(&report, "| Errors | %d |\n", run.Errors)
+
+	if run.Err != "" {
+		fmt.Fprintf(&report, "\nThe run has been aborted: `%s`\n", run.Err)
+	}
+
+	return report.String()
+}
+
+// postToChannel posts the message with the sync account to a channel given as team/channel
+func (auth *AuthenticatorWithSync) postToChannel(teamChannel, message string) error {
+	parts := strings.SplitN(teamChannel, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid report channel %s, expected team/channel", teamChannel)
+	}
+
+	channel, resp := auth.Mattermost().GetChannelByNameForTeamName(parts[1], parts[0], "")
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if _, resp := auth.Mattermost().CreatePost(&model.Post{ChannelId: channel.Id, Message: message}); resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+// postWebhook posts the message to a Mattermost incoming webhook
+func postWebhook(url, message string) error {
+	body, err := json.Marshal(map[string]string{"username": "LDAP Sync", "text": message})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
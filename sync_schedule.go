@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/robfig/cron/v3"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// defaultSyncSchedule syncs every 30 minutes, incrementally if enabled
+const defaultSyncSchedule = "@every 30m"
+
+func (config SyncConfig) schedule() string {
+	if config.Schedule == "" {
+		return defaultSyncSchedule
+	}
+
+	return config.Schedule
+}
+
+// validateSchedules checks the cron expressions of the sync configuration
+func validateSchedules(config SyncConfig) error {
+	for _, schedule := range []string{config.schedule(), config.FullSchedule} {
+		if schedule == "" {
+			continue
+		}
+
+		if _, err := cron.ParseStandard(schedule); err != nil {
+			return fmt.Errorf("invalid sync schedule %s: %v", schedule, err)
+		}
+	}
+
+	return nil
+}
+
+// startSchedule runs the periodic syncs in the background
+func (auth *AuthenticatorWithSync) startSchedule() error {
+	scheduler := cron.New()
+
+	if _, err := scheduler.AddFunc(auth.syncConfig.schedule(), func() { auth.runExclusive("sync", auth.syncChanges) }); err != nil {
+		return err
+	}
+
+	if auth.syncConfig.FullSchedule != "" {
+		if _, err := scheduler.AddFunc(auth.syncConfig.FullSchedule, func() { auth.runExclusive("full sync", auth.syncAllOAuthUsers) }); err != nil {
+			return err
+		}
+	}
+
+	scheduler.Start()
+
+	return nil
+}
+
+// startRun marks a sync as running and returns false if another one already is
+func (auth *AuthenticatorWithSync) startRun() bool {
+	return atomic.CompareAndSwapInt32(&auth.running, 0, 1)
+}
+
+func (auth *AuthenticatorWithSync) finishRun() {
+	atomic.StoreInt32(&auth.running, 0)
+}
+
+// runExclusive runs the sync unless another one is still running
+func (auth *AuthenticatorWithSync) runExclusive(name string, run func()) bool {
+	if !auth.startRun() {
+		logging.Infof("Skipping %s, the previous sync is still running.", name)
+		return false
+	}
+	defer auth.finishRun()
+
+	run()
+
+	return true
+}
+
+// HandleSyncTrigger is a http handler starting a full sync, or syncing the single user given by the user parameter.
+// Requests have to bear the configured trigger token.
+func (auth *AuthenticatorWithSync) HandleSyncTrigger(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if auth.syncConfig.TriggerToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(auth.syncConfig.TriggerToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if uid := r.URL.Query().Get("user"); uid != "" {
+		switch err := auth.syncMattermostForUser(uid); err {
+		case nil:
+			fmt.Fprintf(w, "Synced user %s.\n", uid)
+		case ldapauthenticator.ErrUserNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errUserDisabled:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !auth.startRun() {
+		http.Error(w, "A sync is already running.", http.StatusConflict)
+		return
+	}
+
+	go func() {
+		defer auth.finishRun()
+		auth.syncAllOAuthUsers()
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Started a full sync.")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// syncStats collects timing statistics of a sync run
+type syncStats struct {
+	mutex   sync.Mutex
+	limiter *rateLimiter
+
+	// Kind is either full or incremental
+	Kind     string
+	Started  time.Time
+	Duration time.Duration
+	Users    int
+	// Skipped counts the users left alone since nothing changed
+	Skipped int
+	Errors  int
+	// Err is the error aborting the run, if any
+	Err error
+
+	// APICalls and RateLimitWait are the Mattermost API calls and the time spent waiting for the rate limiter during the run
+	APICalls      int64
+	RateLimitWait time.Duration
+
+	startCalls  int64
+	startWaited time.Duration
+}
+
+func newSyncStats(kind string, limiter *rateLimiter) *syncStats {
+	stats := &syncStats{Kind: kind, limiter: limiter, Started: time.Now()}
+	stats.startCalls, stats.startWaited = limiter.counters()
+
+	return stats
+}
+
+// startStats begins a new run of the given kind with fresh statistics and an empty plan
+func (auth *AuthenticatorWithSync) startStats(kind string) {
+	stats := newSyncStats(kind, auth.mattermost.limiter)
+
+	auth.runMutex.Lock()
+	defer auth.runMutex.Unlock()
+
+	auth.stats = stats
+	auth.plan = newSyncPlan()
+}
+
+// currentStats returns the statistics of the current run. Users synced outside of runs, on login or
+// by the syncrepl listener, are counted into the current or last run.
+func (auth *AuthenticatorWithSync) currentStats() *syncStats {
+	auth.runMutex.RLock()
+	defer auth.runMutex.RUnlock()
+
+	return auth.stats
+}
+
+// finishStats logs the statistics of the run and adds it to the history
+func (auth *AuthenticatorWithSync) finishStats() {
+	stats, plan := auth.currentStats(), auth.Plan()
+
+	stats.finish()
+	stats.log()
+	auth.flushState()
+	auth.recordRun(stats)
+	auth.observeRun(stats, plan)
+	auth.reportRun(stats, plan)
+}
+
+// userSynced counts a synced user, err is the result of its sync
+func (stats *syncStats) userSynced(err error) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Users++
+	if err != nil {
+		stats.Errors++
+	}
+}
+
+// userSkipped counts a user skipped as unchanged
+func (stats *syncStats) userSkipped() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Skipped++
+}
+
+// errorCount returns the number of users failed so far
+func (stats *syncStats) errorCount() int {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	return stats.Errors
+}
+
+// failed records the error aborting the run
+func (stats *syncStats) failed(err error) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Err = err
+}
+
+// finish stops the clock of the run
+func (stats *syncStats) finish() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	calls, waited := stats.limiter.counters()
+	stats.Duration = time.Since(stats.Started)
+	stats.APICalls = calls - stats.startCalls
+	stats.RateLimitWait = waited - stats.startWaited
+}
+
+func (stats *syncStats) log() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	var perUser time.Duration
+	if stats.Users > 0 {
+		perUser = stats.Duration / time.Duration(stats.Users)
+	}
+
+	logging.Infof("Sync (%s) finished in %s: %d users (%s per user), %d unchanged, %d errors, %d Mattermost API calls, %s waited for the rate limit.",
+		stats.Kind, stats.Duration.Round(time.Millisecond), stats.Users, perUser.Round(time.Millisecond), stats.Skipped, stats.Errors, stats.APICalls, stats.RateLimitWait.Round(time.Millisecond))
+}
+
+// run returns the statistics as entry of the run history
+func (stats *syncStats) run() syncRun {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	run := syncRun{
+		Kind:     stats.Kind,
+		Started:  stats.Started,
+		Duration: stats.Duration,
+		Users:    stats.Users,
+		Skipped:  stats.Skipped,
+		Errors:   stats.Errors,
+		APICalls: stats.APICalls,
+	}
+	if stats.Err != nil {
+		run.Err = stats.Err.Error()
+	}
+
+	return run
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/ldapauthenticator"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+const (
+	// bucketSyncreplCookie holds the sync cookie per base DN of the syncrepl sessions
+	bucketSyncreplCookie = "syncrepl-cookie"
+
+	// maxSyncreplBackoff is the maximum delay between two attempts to reopen a broken syncrepl session
+	maxSyncreplBackoff = 5 * time.Minute
+)
+
+// listenForChanges keeps a syncrepl session open for the user and the group base DN and syncs every change
+// right away. Polling is paused while all sessions are up and resumes if the server does not support syncrepl.
+func (auth *AuthenticatorWithSync) listenForChanges() {
+	bases := syncreplBases(auth.userDn, auth.groupBaseDn)
+	atomic.StoreInt32(&auth.listenSessions, int32(len(bases)))
+
+	for _, base := range bases {
+		go auth.listenOnBase(base)
+	}
+}
+
+// syncreplBases returns the distinct subtrees to listen on, dropping DNs below another one
+func syncreplBases(dns ...string) []string {
+	var bases []string
+	for _, dn := range dns {
+		covered := false
+		for _, other := range dns {
+			if other != dn && strings.HasSuffix(strings.ToLower(dn), ","+strings.ToLower(other)) {
+				covered = true
+			}
+		}
+
+		if !covered && dn != "" && !containsFold(bases, dn) {
+			bases = append(bases, dn)
+		}
+	}
+
+	return bases
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listenOnBase runs syncrepl sessions on base, reopening them with increasing delay whenever they break
+func (auth *AuthenticatorWithSync) listenOnBase(base string) {
+	backoff := 10 * time.Second
+	for {
+		handler := &syncreplHandler{auth: auth, base: base, refreshing: true}
+		cookie := auth.syncreplCookie(base)
+		handler.initialRefresh = cookie == nil
+
+		logging.Infof("Opening syncrepl session on %s.", base)
+		attributes := []string{"objectClass", auth.transformer.UIDAttrName, auth.groupSchema.memberAttribute()}
+		err := auth.authenticator.Syncrepl(base, "(objectClass=*)", attributes, cookie, handler)
+
+		if handler.listening {
+			atomic.AddInt32(&auth.listening, -1)
+			backoff = 10 * time.Second
+		}
+
+		if err == ldapauthenticator.ErrSyncreplUnsupported {
+			logging.Errorf("The LDAP server does not support syncrepl on %s, falling back to polling.", base)
+			return
+		}
+
+		logging.Errorf("Syncrepl session on %s failed, retrying in %s. Got error: %+v", base, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxSyncreplBackoff {
+			backoff = maxSyncreplBackoff
+		}
+	}
+}
+
+// isListening returns whether the syncrepl sessions on all bases are up
+func (auth *AuthenticatorWithSync) isListening() bool {
+	sessions := atomic.LoadInt32(&auth.listenSessions)
+	return sessions > 0 && atomic.LoadInt32(&auth.listening) == sessions
+}
+
+func (auth *AuthenticatorWithSync) syncreplCookie(base string) []byte {
+	stored, err := auth.state.Get(bucketSyncreplCookie, strings.ToLower(base))
+	if err != nil || stored == "" {
+		return nil
+	}
+
+	cookie, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil
+	}
+
+	return cookie
+}
+
+// syncreplHandler feeds the notifications of a syncrepl session into the per-user sync
+type syncreplHandler struct {
+	auth *AuthenticatorWithSync
+	base string
+
+	refreshing bool
+	// initialRefresh is set if the session started without cookie, the server then sends all entries.
+	// These are covered by the full sync, only the group members are remembered.
+	initialRefresh bool
+	listening      bool
+}
+
+// Entry syncs the changed user or all users who joined or left the changed group
+func (handler *syncreplHandler) Entry(state ldapauthenticator.SyncState, entry *ldapauthenticator.Entry) {
+	auth := handler.auth
+	skip := handler.refreshing && handler.initialRefresh
+
+	if isPerson(entry) || (state == ldapauthenticator.SyncStateDelete && uidFromDN(entry.DN) != "") {
+		if skip {
+			return
+		}
+
+		uid := entry.GetAttributeValue(auth.transformer.UIDAttrName)
+		if uid == "" {
+			uid = uidFromDN(entry.DN)
+		}
+
+		if state == ldapauthenticator.SyncStateDelete {
+			logging.Infof("User %s has been deleted from LDAP, the next full sync deactivates them.", uid)
+			return
+		}
+
+		handler.syncUID(uid)
+		return
+	}
+
+	members := entry.GetAttributeValues(auth.groupSchema.memberAttribute())
+	stored, err := auth.state.Get(bucketGroupMembers, entry.DN)
+	if err != nil {
+		logging.Errorf("Could not read members of group %s, got error: %+v", entry.DN, err)
+		return
+	}
+	if len(members) == 0 && stored == "" {
+		// neither a user nor a group
+		return
+	}
+
+	sort.Strings(members)
+	groups := map[string][]string{entry.DN: members}
+	if auth.groupSchema.nested {
+		auth.resetGroupGraph()
+	}
+
+	var uids []string
+	if !skip {
+		uids = auth.changedGroupMembers(groups)
+	}
+
+	if err := auth.storeGroupMembers(entry.DN, members); err != nil {
+		logging.Errorf("Could not store members of group %s, got error: %+v", entry.DN, err)
+	}
+
+	for _, uid := range uids {
+		handler.syncUID(uid)
+	}
+}
+
+func (handler *syncreplHandler) syncUID(uid string) {
+	user, err := handler.auth.authenticator.GetUserByID(uid)
+	if err == ldapauthenticator.ErrUserNotFound {
+		return
+	}
+	if err != nil {
+		logging.Errorf("Could not fetch changed user %s, got error: %+v", uid, err)
+		return
+	}
+
+	handler.auth.syncChangedUser(user.(userData))
+}
+
+// Cookie stores the cookie, so a restarted session only receives the changes it missed
+func (handler *syncreplHandler) Cookie(cookie []byte) {
+	encoded := base64.StdEncoding.EncodeToString(cookie)
+	if err := handler.auth.state.Set(bucketSyncreplCookie, strings.ToLower(handler.base), encoded); err != nil {
+		logging.Errorf("Could not store the syncrepl cookie, got error: %+v", err)
+	}
+}
+
+// RefreshDone marks the session as up, pausing the polling sync
+func (handler *syncreplHandler) RefreshDone() {
+	if !handler.refreshing {
+		return
+	}
+
+	handler.refreshing = false
+	handler.listening = true
+	atomic.AddInt32(&handler.auth.listening, 1)
+
+	logging.Infof("Syncrepl session on %s is listening for changes.", handler.base)
+}
+
+func isPerson(entry *ldapauthenticator.Entry) bool {
+	return containsFold(entry.GetAttributeValues("objectClass"), "organizationalPerson")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// teamBinding ties a team to the LDAP group it has been created for, stored by the group's uid
+type teamBinding struct {
+	TeamID string `json:"team_id"`
+	// Name is the team's name, reserved for the group in bucket team-name
+	Name string `json:"name,omitempty"`
+	// MissingSince is set while the group is gone from LDAP
+	MissingSince time.Time `json:"missing_since,omitempty"`
+	Archived     bool      `json:"archived,omitempty"`
+}
+
+func (auth *AuthenticatorWithSync) loadTeamBinding(groupUID string) (*teamBinding, error) {
+	stored, err := auth.state.Get(bucketTeamBinding, groupUID)
+	if err != nil || stored == "" {
+		return nil, err
+	}
+
+	var binding teamBinding
+	if err := json.Unmarshal([]byte(stored), &binding); err != nil {
+		return nil, err
+	}
+
+	return &binding, nil
+}
+
+func (auth *AuthenticatorWithSync) saveTeamBinding(groupUID string, binding *teamBinding) {
+	if auth.dryRun {
+		return
+	}
+
+	var err error
+	if binding == nil {
+		if stored, _ := auth.loadTeamBinding(groupUID); stored != nil && stored.Name != "" {
+			err = auth.state.Delete(bucketTeamName, stored.Name)
+		}
+		if err == nil {
+			err = auth.state.Delete(bucketTeamBinding, groupUID)
+		}
+	} else {
+		var data []byte
+		if data, err = json.Marshal(binding); err == nil {
+			err = auth.state.Set(bucketTeamBinding, groupUID, string(data))
+		}
+		if err == nil && binding.Name != "" {
+			err = auth.state.Set(bucketTeamName, binding.Name, groupUID)
+		}
+	}
+
+	if err != nil {
+		logging.Errorf("Could not store the team of group %s, got error: %+v", groupUID, err)
+	}
+}
+
+// bindTeam remembers the team created for the group
+func (auth *AuthenticatorWithSync) bindTeam(groupUID string, team *model.Team) {
+	auth.saveTeamBinding(groupUID, &teamBinding{TeamID: team.Id, Name: team.Name})
+}
+
+// syncTeamLifecycle keeps the teams bound to LDAP groups in line with them: display names follow the group's cn,
+// teams of vanished groups are archived after the grace period and restored once their group returns
+func (auth *AuthenticatorWithSync) syncTeamLifecycle() {
+	groups, err := auth.fetchAllGroups()
+	if err != nil {
+		// never archive anything if the groups could not be fetched
+		logging.Errorf("Could not fetch the LDAP groups, got error: %+v", err)
+		return
+	}
+
+	present := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		if group.uid == "" {
+			continue
+		}
+		present[group.uid] = true
+		auth.syncBoundTeam(group)
+	}
+
+	groupUIDs, err := auth.state.Keys(bucketTeamBinding)
+	if err != nil {
+		logging.Errorf("Could not read the teams of LDAP groups, got error: %+v", err)
+		return
+	}
+
+	for _, groupUID := range groupUIDs {
+		if !present[groupUID] {
+			auth.archiveVanishedTeam(groupUID)
+		}
+	}
+}
+
+// syncBoundTeam restores and renames the team bound to an existing group. A team named like the group's normalized uid
+// is adopted if the group has no team yet, e.g. on installations predating the bindings. Only teams archived by the
+// sync itself are restored.
+func (auth *AuthenticatorWithSync) syncBoundTeam(group group) {
+	name := auth.teamNameForGroup(group.uid)
+	if !auth.teamPolicy.manages(name) {
+		return
+	}
+
+	binding, err := auth.loadTeamBinding(group.uid)
+	if err != nil {
+		logging.Errorf("Could not read the team of group %s, got error: %+v", group.uid, err)
+		return
+	}
+
+	if binding == nil {
+		if binding = auth.adoptTeam(group.uid); binding == nil {
+			return
+		}
+	}
+
+	team, resp := auth.Mattermost().GetTeam(binding.TeamID, "")
+	if resp.Error != nil {
+		if resp.StatusCode == 404 {
+			// the team has been deleted permanently
+			auth.saveTeamBinding(group.uid, nil)
+			return
+		}
+
+		logging.Errorf("Could not find team of group %s, got error: %+v", group.uid, resp.Error)
+		return
+	}
+
+	binding.MissingSince = time.Time{}
+	binding.Name = team.Name
+
+	if team.DeleteAt != 0 && !binding.Archived {
+		// archived by an admin
+		auth.saveTeamBinding(group.uid, binding)
+		return
+	}
+
+	if team.DeleteAt != 0 && auth.planChange(actionRestoreTeam, "", team.Name, "") {
+		if err := auth.restoreTeam(team.Id); err != nil {
+			logging.Errorf("Could not restore team %s, got error: %+v", team.Name, err)
+			auth.changeFailed(actionRestoreTeam, "", team.Name)
+		} else {
+			binding.Archived = false
+			logging.Infof("Restored team %s, its LDAP group %s returned.", team.Name, group.uid)
+		}
+	}
+
+	if group.name != "" && team.DisplayName != group.name && auth.planChange(actionRenameTeam, "", team.Name, group.name) {
+		patch := model.TeamPatch{DisplayName: &group.name}
+		if _, resp := auth.Mattermost().PatchTeam(team.Id, &patch); resp.Error != nil {
+			logging.Errorf("Could not rename team %s, got error: %+v", team.Name, resp.Error)
+			auth.changeFailed(actionRenameTeam, "", team.Name)
+		} else {
+			logging.Infof("Renamed team %s from %s to %s.", team.Name, team.DisplayName, group.name)
+		}
+	}
+
+	auth.saveTeamBinding(group.uid, binding)
+}
+
+// adoptTeam binds the existing team named like the group's normalized uid to the group,
+// unless it is bound to another group. It returns nil if there is no such team.
+func (auth *AuthenticatorWithSync) adoptTeam(groupUID string) *teamBinding {
+	name := auth.normalizeGroupName(groupUID)
+	if owner, err := auth.state.Get(bucketTeamName, name); err != nil || owner != "" {
+		return nil
+	}
+
+	team, resp := auth.Mattermost().GetTeamByName(name, "")
+	if resp.Error != nil {
+		if resp.StatusCode != 404 {
+			logging.Errorf("Could not find team %s of group %s, got error: %+v", name, groupUID, resp.Error)
+		}
+		return nil
+	}
+
+	// a team archived before the adoption counts as archived by an admin and is never restored
+	binding := &teamBinding{TeamID: team.Id, Name: team.Name}
+	auth.saveTeamBinding(groupUID, binding)
+	logging.Infof("Adopted team %s for LDAP group %s.", team.Name, groupUID)
+
+	return binding
+}
+
+// archiveVanishedTeam archives the team of a group gone from LDAP once the grace period passed
+func (auth *AuthenticatorWithSync) archiveVanishedTeam(groupUID string) {
+	if auth.syncConfig.TeamArchiveGracePeriod == "" {
+		return
+	}
+
+	binding, err := auth.loadTeamBinding(groupUID)
+	if err != nil || binding == nil {
+		return
+	}
+
+	if binding.Archived {
+		return
+	}
+
+	if binding.MissingSince.IsZero() {
+		binding.MissingSince = time.Now()
+		auth.saveTeamBinding(groupUID, binding)
+	}
+
+	if time.Since(binding.MissingSince) < auth.teamArchiveGracePeriod {
+		return
+	}
+
+	team, resp := auth.Mattermost().GetTeam(binding.TeamID, "")
+	if resp.Error != nil {
+		if resp.StatusCode == 404 {
+			auth.saveTeamBinding(groupUID, nil)
+			return
+		}
+
+		logging.Errorf("Could not find team of group %s, got error: %+v", groupUID, resp.Error)
+		return
+	}
+
+	if !auth.teamPolicy.manages(team.Name) || !auth.teamPolicy.mayRemove(team) {
+		return
+	}
+
+	if team.DeleteAt != 0 {
+		// archived by an admin, it must not be restored once the group returns
+		return
+	}
+
+	if !auth.planChange(actionArchiveTeam, "", team.Name, "group "+groupUID+" vanished") {
+		return
+	}
+
+	if _, resp := auth.Mattermost().SoftDeleteTeam(team.Id); resp.Error != nil {
+		logging.Errorf("Could not archive team %s, got error: %+v", team.Name, resp.Error)
+		auth.changeFailed(actionArchiveTeam, "", team.Name)
+		return
+	}
+
+	logging.Infof("Archived team %s, its LDAP group %s vanished.", team.Name, groupUID)
+
+	binding.Archived = true
+	auth.saveTeamBinding(groupUID, binding)
+}
+
+// restoreTeam restores an archived team, the endpoint is unknown to the vendored client
+func (auth *AuthenticatorWithSync) restoreTeam(teamID string) error {
+	client := auth.Mattermost()
+	resp, err := client.DoApiPost(client.GetTeamRoute(teamID)+"/restore", "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
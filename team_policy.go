@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// teamPolicy decides which Mattermost teams are managed by the sync
+type teamPolicy struct {
+	// managed and unmanaged hold shell patterns of team names, an empty managed list matches every team
+	managed   []string
+	unmanaged []string
+
+	// neverRemove keeps users in their teams even if they left the LDAP group
+	neverRemove bool
+	// protectedMarker excludes every team holding it in its description from removal
+	protectedMarker string
+}
+
+func newTeamPolicy(config SyncConfig) (teamPolicy, error) {
+	var policy teamPolicy
+
+	for _, pattern := range append(append([]string{}, config.ManagedTeam...), config.UnmanagedTeam...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return policy, err
+		}
+	}
+
+	policy.managed = config.ManagedTeam
+	policy.unmanaged = config.UnmanagedTeam
+	policy.neverRemove = config.NeverRemove
+	policy.protectedMarker = config.ProtectedTeamMarker
+
+	return policy, nil
+}
+
+// manages returns whether the team with the given name is managed by the sync at all
+func (policy teamPolicy) manages(name string) bool {
+	if matchesAny(policy.unmanaged, name) {
+		return false
+	}
+
+	return len(policy.managed) == 0 || matchesAny(policy.managed, name)
+}
+
+// mayAdd returns whether the sync may add users to the team with the given name
+func (policy teamPolicy) mayAdd(name string) bool {
+	return policy.manages(name)
+}
+
+// mayRemove returns whether the sync may remove users from the given team
+func (policy teamPolicy) mayRemove(team *model.Team) bool {
+	if policy.neverRemove || !policy.manages(team.Name) {
+		return false
+	}
+
+	return policy.protectedMarker == "" || !strings.Contains(team.Description, policy.protectedMarker)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// teamTemplate describes the teams created for LDAP groups
+type teamTemplate struct {
+	teamType string
+	// description may contain the placeholders {name}, {uid} and {description} of the group
+	description     string
+	allowedDomains  string
+	defaultChannels []string
+	// maxNameLength is the longest team name, longer names are truncated and suffixed with a hash
+	maxNameLength int
+}
+
+var (
+	// transliterations are applied before the remaining accents are stripped
+	transliterations = strings.NewReplacer("ä", "ae", "ö", "oe", "ü", "ue", "Ä", "Ae", "Ö", "Oe", "Ü", "Ue", "ß", "ss")
+	invalidTeamName  = regexp.MustCompile(`[^a-z0-9-]`)
+)
+
+const minTeamNameLength = 16
+
+func newTeamTemplate() teamTemplate {
+	return teamTemplate{teamType: model.TEAM_INVITE, maxNameLength: model.TEAM_NAME_MAX_LENGTH}
+}
+
+// ConfigureTeams applies the team section of the configuration
+func (auth *AuthenticatorWithSync) ConfigureTeams(config TeamConfig) error {
+	template := newTeamTemplate()
+
+	switch config.Type {
+	case "", "invite":
+	case "open":
+		template.teamType = model.TEAM_OPEN
+	default:
+		return fmt.Errorf("unknown team type %s, expected open or invite", config.Type)
+	}
+
+	if config.MaxNameLength != 0 {
+		if config.MaxNameLength < minTeamNameLength || config.MaxNameLength > model.TEAM_NAME_MAX_LENGTH {
+			return fmt.Errorf("maxNameLength has to be between %d and %d", minTeamNameLength, model.TEAM_NAME_MAX_LENGTH)
+		}
+		template.maxNameLength = config.MaxNameLength
+	}
+
+	for _, channel := range config.DefaultChannel {
+		if !model.IsValidChannelIdentifier(channel) {
+			return fmt.Errorf("invalid default channel name %s", channel)
+		}
+	}
+
+	template.description = config.Description
+	template.allowedDomains = config.AllowedDomains
+	template.defaultChannels = config.DefaultChannel
+	auth.teamTemplate = template
+
+	return nil
+}
+
+// normalizeGroupName derives a valid team name from the group's uid: transliterated, lowercased,
+// with invalid characters replaced by hyphens and truncated to the maximum length
+func (auth *AuthenticatorWithSync) normalizeGroupName(uid string) string {
+	name := strings.ToLower(transliterate(uid))
+	name = strings.Trim(invalidTeamName.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		// nothing is left of uids in other scripts, only the hash tells them apart
+		return auth.suffixedTeamName("team", uid)
+	}
+
+	if len(name) < model.TEAM_NAME_MIN_LENGTH || model.IsReservedTeamName(name) {
+		name = strings.Trim("team-"+name, "-")
+	}
+
+	if len(name) > auth.teamTemplate.maxNameLength {
+		name = auth.suffixedTeamName(name, uid)
+	}
+
+	return name
+}
+
+// suffixedTeamName appends a hash of the group's uid to the name, keeping it within the maximum length
+func (auth *AuthenticatorWithSync) suffixedTeamName(name, uid string) string {
+	hash := sha256.Sum256([]byte(uid))
+	suffix := "-" + hex.EncodeToString(hash[:])[:8]
+
+	if length := auth.teamTemplate.maxNameLength - len(suffix); len(name) > length {
+		name = name[:length]
+	}
+
+	return strings.TrimRight(name, "-") + suffix
+}
+
+// transliterate replaces umlauts and strips accents, other non-ASCII characters are left to the caller
+func transliterate(value string) string {
+	value = transliterations.Replace(value)
+
+	stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), value)
+	if err != nil {
+		return value
+	}
+
+	return stripped
+}
+
+// teamNameForGroup returns the name of the group's team: the name of the bound team, otherwise the normalized uid
+// or, if another group's team already has that name, the normalized uid suffixed with a hash
+func (auth *AuthenticatorWithSync) teamNameForGroup(uid string) string {
+	binding, err := auth.loadTeamBinding(uid)
+	if err != nil {
+		logging.Errorf("Could not read the team of group %s, got error: %+v", uid, err)
+	} else if binding != nil && binding.Name != "" {
+		return binding.Name
+	}
+
+	name := auth.normalizeGroupName(uid)
+	if owner, err := auth.state.Get(bucketTeamName, name); err == nil && owner != "" && owner != uid {
+		return auth.suffixedTeamName(name, uid)
+	}
+
+	return name
+}
+
+// newTeam returns the team to create for the group
+func (auth *AuthenticatorWithSync) newTeam(group group, name string) *model.Team {
+	template := auth.teamTemplate
+	placeholders := strings.NewReplacer("{name}", group.name, "{uid}", group.uid, "{description}", group.description)
+
+	return &model.Team{
+		Name:            name,
+		DisplayName:     group.name,
+		Type:            template.teamType,
+		AllowOpenInvite: template.teamType == model.TEAM_OPEN,
+		Description:     placeholders.Replace(template.description),
+		AllowedDomains:  template.allowedDomains,
+	}
+}
+
+// joinDefaultChannels adds a new team member to the default channels of the template, creating them if necessary
+func (auth *AuthenticatorWithSync) joinDefaultChannels(team *model.Team, user *model.User) error {
+	var errs syncErrors
+	for _, name := range auth.teamTemplate.defaultChannels {
+		mapping := channelMapping{name: name, team: team.Name, displayName: name}
+
+		channel, resp := auth.Mattermost().GetChannelByName(name, team.Id, "")
+		if resp.Error != nil && resp.StatusCode != 404 {
+			logging.Errorf("Could not find channel %s, got error: %+v", name, resp.Error)
+			errs.add(resp.Error)
+			continue
+		}
+
+		if resp.StatusCode == 404 {
+			var err error
+			if channel, err = auth.createMappedChannel(team, mapping); channel == nil {
+				errs.add(err)
+				continue
+			}
+		}
+
+		if _, resp := auth.Mattermost().GetChannelMember(channel.Id, user.Id, ""); resp.StatusCode == 404 {
+			errs.add(auth.addChannelMember(team, channel, user))
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// hashSuffix is the suffix suffixedTeamName appends for the uid
+func hashSuffix(uid string) string {
+	hash := sha256.Sum256([]byte(uid))
+	return "-" + hex.EncodeToString(hash[:])[:8]
+}
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"Müller", "Mueller"},
+		{"ÄÖÜ äöü ß", "AeOeUe aeoeue ss"},
+		{"Café Crème", "Cafe Creme"},
+		{"Señora Łukasz", "Senora Łukasz"},
+		{"Иван", "Иван"},
+		{"plain", "plain"},
+	}
+
+	for _, test := range tests {
+		if actual := transliterate(test.value); actual != test.expected {
+			t.Errorf("transliterate(%q) = %q, expected %q", test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestNormalizeGroupName(t *testing.T) {
+	long := strings.Repeat("abcdefghij", 7)
+
+	tests := []struct {
+		name          string
+		uid           string
+		maxNameLength int
+		expected      string
+	}{
+		{"lowercased", "Vorstand", 0, "vorstand"},
+		{"umlauts", "Grüne Äpfel", 0, "gruene-aepfel"},
+		{"accents", "Café-Crème", 0, "cafe-creme"},
+		{"invalid characters", "AG_Berlin.Süd", 0, "ag-berlin-sued"},
+		{"trimmed hyphens", "--team--", 0, "team"},
+		{"too short", "a", 0, "team-a"},
+		{"reserved", "admin", 0, "team-admin"},
+		{"other script", "Иван", 0, "team" + hashSuffix("Иван")},
+		{"truncated", long, 0, long[:64-9] + hashSuffix(long)},
+		{"configured length", "arbeitsgruppe-oeffentlichkeit", 20, "arbeitsgrup" + hashSuffix("arbeitsgruppe-oeffentlichkeit")},
+		{"no trailing hyphen before suffix", "arbeitsgruppe-oeffentlichkeit", 23, "arbeitsgruppe" + hashSuffix("arbeitsgruppe-oeffentlichkeit")},
+	}
+
+	for _, test := range tests {
+		auth := NewAuthenticatorWithSync("", "", "", "", "", Transformer{})
+		if test.maxNameLength != 0 {
+			auth.teamTemplate.maxNameLength = test.maxNameLength
+		}
+
+		actual := auth.normalizeGroupName(test.uid)
+		if actual != test.expected {
+			t.Errorf("%s: normalizeGroupName(%q) = %q, expected %q", test.name, test.uid, actual, test.expected)
+		}
+		if len(actual) > auth.teamTemplate.maxNameLength {
+			t.Errorf("%s: %q is longer than %d characters", test.name, actual, auth.teamTemplate.maxNameLength)
+		}
+	}
+}
+
+func TestTeamNameForGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		uid      string
+		binding  string
+		owner    string
+		expected string
+	}{
+		{"free name", "Müller", "", "", "mueller"},
+		{"own name", "Müller", "", "Müller", "mueller"},
+		{"collision", "Müller", "", "mueller", "mueller" + hashSuffix("Müller")},
+		{"bound team", "Müller", `{"team_id":"t1","name":"old-name"}`, "mueller", "old-name"},
+		{"binding without name", "Müller", `{"team_id":"t1"}`, "", "mueller"},
+	}
+
+	for _, test := range tests {
+		auth := NewAuthenticatorWithSync("", "", "", "", "", Transformer{})
+		if test.binding != "" {
+			auth.state.Set(bucketTeamBinding, test.uid, test.binding)
+		}
+		if test.owner != "" {
+			auth.state.Set(bucketTeamName, "mueller", test.owner)
+		}
+
+		if actual := auth.teamNameForGroup(test.uid); actual != test.expected {
+			t.Errorf("%s: teamNameForGroup(%q) = %q, expected %q", test.name, test.uid, actual, test.expected)
+		}
+	}
+}
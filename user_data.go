@@ -1,17 +1,47 @@
 package main
 
+import "strconv"
+
+const (
+	// userStateActive marks a user allowed to use Mattermost
+	userStateActive = "active"
+	// userStateBlocked marks a user disabled in LDAP, named after GitLab's state
+	userStateBlocked = "blocked"
+)
+
 type userData struct {
-	Email    string `json:"email"`
-	ID       int64  `json:"id"`
-	Name     string `json:"name"`
-	Username string `json:"username"`
-	State    string `json:"state"`
+	Email     string `json:"email"`
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Username  string `json:"username"`
+	State     string `json:"state"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Nickname  string `json:"nickname,omitempty"`
+	Position  string `json:"position,omitempty"`
+	Locale    string `json:"locale,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	// UID is the raw LDAP uid the user has been looked up with
+	UID string `json:"-"`
+	// Modified is the value of the change attribute, it is only read if pictures are synced
+	Modified string `json:"-"`
 }
 
 func newUserData() userData {
 	var data userData
 
-	data.State = "active"
+	data.State = userStateActive
 
 	return data
 }
+
+// authData returns the AuthData identifying the user in Mattermost
+func (data userData) authData() string {
+	return strconv.FormatInt(data.ID, 10)
+}
+
+// isActive returns false if the user has been flagged disabled in LDAP
+func (data userData) isActive() bool {
+	return data.State == userStateActive
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// userGroupMapping mirrors LDAP groups as a Mattermost user group, the name is the group's @-mention
+type userGroupMapping struct {
+	name        string
+	displayName string
+	groups      []string
+	// direct only counts direct members of the groups if nested groups are resolved
+	direct bool
+}
+
+// userGroup is a Mattermost custom user group, unknown to the vendored client
+type userGroup struct {
+	ID             string `json:"id,omitempty"`
+	Name           string `json:"name"`
+	DisplayName    string `json:"display_name"`
+	Source         string `json:"source"`
+	AllowReference bool   `json:"allow_reference"`
+	DeleteAt       int64  `json:"delete_at,omitempty"`
+}
+
+// newUserGroup is the flat body creating a custom user group together with its initial members
+type newUserGroup struct {
+	userGroup
+	UserIDs []string `json:"user_ids"`
+}
+
+// userGroupMembers collects the members of every mirrored user group during a full sync. Users synced
+// successfully but not collected as members are removed once the run is done.
+type userGroupMembers struct {
+	mutex   sync.Mutex
+	members map[string]map[string]bool
+	// synced holds the ids of all users synced without errors
+	synced map[string]bool
+}
+
+// ConfigureUserGroups applies the userGroup section of the configuration
+func (auth *AuthenticatorWithSync) ConfigureUserGroups(userGroups map[string]*UserGroupConfig) error {
+	auth.userGroupMappings = nil
+
+	for name, userGroup := range userGroups {
+		if !model.IsValidUsername(name) {
+			return fmt.Errorf("invalid user group name %s", name)
+		}
+
+		mapping := userGroupMapping{
+			name:        name,
+			displayName: userGroup.DisplayName,
+			groups:      userGroup.Group,
+			direct:      strings.EqualFold(userGroup.Membership, membershipDirect),
+		}
+
+		if mapping.displayName == "" {
+			mapping.displayName = name
+		}
+
+		auth.userGroupMappings = append(auth.userGroupMappings, mapping)
+	}
+
+	// keep the order of applied changes stable
+	sort.Slice(auth.userGroupMappings, func(i, j int) bool {
+		return auth.userGroupMappings[i].name < auth.userGroupMappings[j].name
+	})
+
+	return nil
+}
+
+// matches returns whether one of the given groups feeds this user group
+func (mapping userGroupMapping) matches(groups []group) bool {
+	return inAnyGroup(membershipGroups(groups, mapping.direct), mapping.groups)
+}
+
+// syncUserGroupsForUser adds the user to the mirrored user groups of their LDAP groups and removes them from all others
+func (auth *AuthenticatorWithSync) syncUserGroupsForUser(user *model.User, groups []group) error {
+	logger := logging.With("user", user.Username)
+
+	if len(auth.userGroupMappings) == 0 {
+		return nil
+	}
+
+	current, err := auth.userGroupsOfUser(user.Id)
+	if err != nil {
+		logger.Errorf("Could not fetch the user groups of %s, got error: %+v", user.Username, err)
+		return err
+	}
+
+	var errs syncErrors
+	for _, mapping := range auth.userGroupMappings {
+		member := mapping.matches(groups)
+
+		group, isMember := current[mapping.name]
+		if !isMember && member {
+			var err error
+			if group, err = auth.ensureUserGroup(mapping); group == nil {
+				errs.add(err)
+				if auth.dryRun {
+					auth.planChange(actionAddUserGroupMember, user.Username, mapping.name, "")
+				}
+				continue
+			}
+		}
+
+		if member && !isMember {
+			errs.add(auth.changeUserGroupMembers(actionAddUserGroupMember, group, []*model.User{user}))
+		}
+
+		if !member && isMember {
+			errs.add(auth.changeUserGroupMembers(actionRemoveUserGroupMember, group, []*model.User{user}))
+		}
+	}
+
+	return errs.err()
+}
+
+// expectUserGroupMembers remembers the mirrored user groups of a user synced successfully during a full sync
+func (auth *AuthenticatorWithSync) expectUserGroupMembers(user *model.User, groups []group) {
+	auth.runMutex.RLock()
+	expected := auth.userGroupMembers
+	auth.runMutex.RUnlock()
+	if expected == nil {
+		return
+	}
+
+	expected.mutex.Lock()
+	defer expected.mutex.Unlock()
+
+	expected.synced[user.Id] = true
+
+	for _, mapping := range auth.userGroupMappings {
+		if mapping.matches(groups) {
+			expected.members[mapping.name][user.Id] = true
+		}
+	}
+}
+
+// startUserGroupRun begins collecting the members of all mirrored user groups for a full sync
+func (auth *AuthenticatorWithSync) startUserGroupRun() {
+	expected := &userGroupMembers{members: make(map[string]map[string]bool), synced: make(map[string]bool)}
+	for _, mapping := range auth.userGroupMappings {
+		expected.members[mapping.name] = make(map[string]bool)
+	}
+
+	auth.runMutex.Lock()
+	defer auth.runMutex.Unlock()
+
+	auth.userGroupMembers = expected
+}
+
+// finishUserGroupRun removes the users synced by the full sync from the mirrored user groups they do not
+// belong to anymore. Nothing is removed if the run had errors, the collected members may be incomplete.
+func (auth *AuthenticatorWithSync) finishUserGroupRun() {
+	auth.runMutex.Lock()
+	expected := auth.userGroupMembers
+	auth.userGroupMembers = nil
+	auth.runMutex.Unlock()
+	if expected == nil {
+		return
+	}
+
+	if errors := auth.currentStats().errorCount(); errors > 0 {
+		logging.Infof("Skipping the cleanup of user groups, %d users failed to sync.", errors)
+		return
+	}
+
+	for _, mapping := range auth.userGroupMappings {
+		group := auth.findUserGroup(mapping.name)
+		if group == nil {
+			continue
+		}
+
+		members, err := auth.userGroupMemberList(group.ID)
+		if err != nil {
+			logging.Errorf("Could not fetch the members of user group %s, got error: %+v", mapping.name, err)
+			continue
+		}
+
+		var stale []*model.User
+		for _, member := range members {
+			if expected.synced[member.Id] && !expected.members[mapping.name][member.Id] {
+				stale = append(stale, member)
+			}
+		}
+
+		if len(stale) > 0 {
+			auth.changeUserGroupMembers(actionRemoveUserGroupMember, group, stale)
+		}
+	}
+}
+
+// changeUserGroupMembers adds or removes the users, action is either actionAddUserGroupMember or actionRemoveUserGroupMember
+func (auth *AuthenticatorWithSync) changeUserGroupMembers(action string, group *userGroup, users []*model.User) error {
+	var userIDs []string
+	var planned []*model.User
+	for _, user := range users {
+		if auth.planChange(action, user.Username, group.Name, "") {
+			userIDs = append(userIDs, user.Id)
+			planned = append(planned, user)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	method, verb := "POST", "Added"
+	if action == actionRemoveUserGroupMember {
+		method, verb = "DELETE", "Removed"
+	}
+
+	body, _ := json.Marshal(map[string][]string{"user_ids": userIDs})
+	client := auth.Mattermost()
+	resp, err := client.DoApiRequest(method, client.GetGroupRoute(group.ID)+"/members", string(body), "")
+	if err != nil {
+		logging.Errorf("Could not update the members of user group %s, got error: %+v", group.Name, err)
+		for _, user := range planned {
+			auth.changeFailed(action, user.Username, group.Name)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	logging.Infof("%s %d users in user group @%s.", verb, len(userIDs), group.Name)
+
+	return nil
+}
+
+// ensureUserGroup returns the user group of the mapping, creating it if necessary. It returns nil if it has not been created.
+func (auth *AuthenticatorWithSync) ensureUserGroup(mapping userGroupMapping) (*userGroup, error) {
+	if group := auth.findUserGroup(mapping.name); group != nil {
+		return group, nil
+	}
+
+	auth.creationMutex.Lock()
+	defer auth.creationMutex.Unlock()
+
+	// another worker may have created the group meanwhile
+	if group := auth.findUserGroup(mapping.name); group != nil {
+		return group, nil
+	}
+
+	if !auth.planChange(actionCreateUserGroup, "", mapping.name, mapping.displayName) {
+		return nil, nil
+	}
+
+	newGroup := newUserGroup{
+		userGroup: userGroup{Name: mapping.name, DisplayName: mapping.displayName, Source: "custom", AllowReference: true},
+		UserIDs:   []string{},
+	}
+	body, _ := json.Marshal(newGroup)
+
+	client := auth.Mattermost()
+	resp, appErr := client.DoApiPost(client.GetGroupsRoute(), string(body))
+	if appErr != nil {
+		logging.Errorf("Could not create user group %s, got error: %+v", mapping.name, appErr)
+		auth.changeFailed(actionCreateUserGroup, "", mapping.name)
+		return nil, appErr
+	}
+	defer resp.Body.Close()
+
+	var group userGroup
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		logging.Errorf("Could not read the created user group %s, got error: %+v", mapping.name, err)
+		return nil, err
+	}
+
+	logging.Infof("Created new user group @%s.", group.Name)
+
+	return &group, nil
+}
+
+// findUserGroup returns the custom user group with the given name or nil if there is none
+func (auth *AuthenticatorWithSync) findUserGroup(name string) *userGroup {
+	query := url.Values{"q": {name}, "filter_allow_reference": {"true"}, "per_page": {"200"}}
+
+	client := auth.Mattermost()
+	resp, appErr := client.DoApiGet(client.GetGroupsRoute()+"?"+query.Encode(), "")
+	if appErr != nil {
+		logging.Errorf("Could not search user group %s, got error: %+v", name, appErr)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var groups []userGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		logging.Errorf("Could not read user groups, got error: %+v", err)
+		return nil
+	}
+
+	for _, group := range groups {
+		if group.Name == name && group.DeleteAt == 0 {
+			return &group
+		}
+	}
+
+	return nil
+}
+
+// userGroupsOfUser returns the custom user groups of the user by name
+func (auth *AuthenticatorWithSync) userGroupsOfUser(userID string) (map[string]*userGroup, error) {
+	client := auth.Mattermost()
+	resp, appErr := client.DoApiGet(client.GetUserRoute(userID)+"/groups", "")
+	if appErr != nil {
+		return nil, appErr
+	}
+	defer resp.Body.Close()
+
+	var groups []userGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*userGroup, len(groups))
+	for i := range groups {
+		if groups[i].Source == "custom" && groups[i].DeleteAt == 0 {
+			byName[groups[i].Name] = &groups[i]
+		}
+	}
+
+	return byName, nil
+}
+
+// userGroupMemberList returns all members of the user group
+func (auth *AuthenticatorWithSync) userGroupMemberList(groupID string) ([]*model.User, error) {
+	var members []*model.User
+	for page := 0; ; page++ {
+		client := auth.Mattermost()
+		resp, appErr := client.DoApiGet(fmt.Sprintf("%s/members?page=%d&per_page=200", client.GetGroupRoute(groupID), page), "")
+		if appErr != nil {
+			return nil, appErr
+		}
+
+		var result struct {
+			Members []*model.User `json:"members"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, result.Members...)
+		if len(result.Members) < 200 {
+			return members, nil
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/studieren-ohne-grenzen/mattermost-ldap/logging"
+)
+
+// migrateEmailUsers converts Mattermost users signed up with email and password to OAuth users
+// if they match an LDAP entry, so they keep their history after switching to LDAP. Users are matched by
+// their verified email address, or with matchBy map by the username to uid pairs of the mapping file,
+// since usernames are chosen by the users themselves.
+func (auth *AuthenticatorWithSync) migrateEmailUsers(matchBy, mappingPath string) error {
+	auth.resetPlan()
+
+	var mapping map[string]string
+	if matchBy == "map" {
+		var err error
+		if mapping, err = readMigrationMapping(mappingPath); err != nil {
+			return err
+		}
+	}
+
+	if err := auth.checkMattermostConnection(); err != nil {
+		return err
+	}
+
+	emailUsers, err := auth.getAllUsers(func(user *model.User) bool {
+		return user.AuthService == "" || user.AuthService == model.USER_AUTH_SERVICE_EMAIL
+	})
+	if err != nil {
+		return err
+	}
+
+	oauthUsers, err := auth.getAllOAuthUsers()
+	if err != nil {
+		return err
+	}
+
+	takenAuthData := make(map[string]string, len(oauthUsers))
+	for _, user := range oauthUsers {
+		if user.AuthData != nil {
+			takenAuthData[*user.AuthData] = user.Username
+		}
+	}
+
+	ldapUsers, err := auth.authenticator.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	ldapUsersByKey := make(map[string]userData, len(ldapUsers))
+	// ambiguous holds mails shared by several LDAP entries, they match none of them
+	ambiguous := make(map[string]bool)
+	for _, ldapUser := range ldapUsers {
+		data := ldapUser.(userData)
+		key := strings.ToLower(data.Email)
+		if matchBy == "map" {
+			key = strings.ToLower(data.UID)
+		}
+
+		if key == "" {
+			continue
+		}
+
+		if _, duplicate := ldapUsersByKey[key]; duplicate {
+			ambiguous[key] = true
+		}
+		ldapUsersByKey[key] = data
+	}
+
+	for _, user := range emailUsers {
+		key := strings.ToLower(user.Email)
+		if matchBy == "map" {
+			uid, mapped := mapping[strings.ToLower(user.Username)]
+			if !mapped {
+				continue
+			}
+			key = strings.ToLower(uid)
+		}
+
+		data, found := ldapUsersByKey[key]
+		if !found {
+			if matchBy == "map" {
+				logging.Errorf("Could not migrate user %s, there is no LDAP user %s.", user.Username, key)
+			}
+			continue
+		}
+
+		if ambiguous[key] {
+			logging.Errorf("Could not migrate user %s, several LDAP users share %s.", user.Username, key)
+			auth.planChange(actionConflict, user.Username, key, "ambiguous LDAP match")
+			continue
+		}
+
+		if matchBy == "mail" && !user.EmailVerified {
+			logging.Errorf("Could not migrate user %s, the email address %s is not verified.", user.Username, user.Email)
+			auth.planChange(actionConflict, user.Username, data.UID, "email not verified")
+			continue
+		}
+
+		auth.migrateEmailUser(user, data, matchBy, takenAuthData)
+	}
+
+	return nil
+}
+
+// readMigrationMapping reads the lines "username uid" of an admin provided mapping file, lines starting with # are comments
+func readMigrationMapping(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(map[string]string)
+	for number, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a username and a uid", path, number+1)
+		}
+		mapping[strings.ToLower(fields[0])] = fields[1]
+	}
+
+	return mapping, nil
+}
+
+func (auth *AuthenticatorWithSync) migrateEmailUser(user *model.User, data userData, matchBy string, takenAuthData map[string]string) {
+	authData := data.authData()
+	if other, taken := takenAuthData[authData]; taken {
+		logging.Errorf("Could not migrate user %s, LDAP user %s is already bound to %s.", user.Username, data.UID, other)
+		auth.planChange(actionConflict, user.Username, data.UID, "already bound to "+other)
+		return
+	}
+
+	if !auth.planChange(actionMigrateUser, user.Username, data.UID, "matched by "+matchBy) {
+		return
+	}
+
+	userAuth := model.UserAuth{AuthService: auth.authService, AuthData: &authData}
+	if _, resp := auth.Mattermost().UpdateUserAuth(user.Id, &userAuth); resp.Error != nil {
+		logging.Errorf("Could not migrate user %s, got error: %+v", user.Username, resp.Error)
+		auth.changeFailed(actionMigrateUser, user.Username, data.UID)
+		return
+	}
+
+	takenAuthData[authData] = user.Username
+	logging.Infof("Migrated user %s to LDAP user %s, the next sync updates the profile.", user.Username, data.UID)
+}